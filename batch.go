@@ -0,0 +1,186 @@
+package mailboxoperator
+
+// batch provides the grouping of messages into batches for a
+// BatchOperator, such as for bulk inserts into a database.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// The default batch size and maximum latency, set by WithBatchSize.
+const (
+	defaultBatchSize    = 100
+	defaultBatchLatency = time.Second
+)
+
+// Message is a buffered message passed to a BatchOperator. Data is
+// only valid for the duration of the call to OperateBatch.
+type Message struct {
+	*mailfile.MailFile
+	Data []byte
+}
+
+// BatchOperator is an Operator which is passed batches of messages by
+// OperateBatch, used in place of Operate, unless streaming. Messages
+// are grouped into batches of up to the size set by WithBatchSize
+// before being handed to the workers, each batch being passed on once
+// full or once its first message has waited the maximum latency.
+//
+// OperateBatch may return a BatchError to report the errors of
+// individual messages. Any other error applies to each message of the
+// batch. Errors are reported per message as an OperationError, and a
+// panic as a PanicError with the MailFile of the first message.
+type BatchOperator interface {
+	Operator
+	OperateBatch(msgs []Message) error
+}
+
+// BatchError is returned by OperateBatch to report the error, or nil,
+// of each message of a batch, in order.
+type BatchError []error
+
+func (b BatchError) Error() string {
+	var first error
+	n := 0
+	for _, err := range b {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	if first == nil {
+		return fmt.Sprintf("no errors in batch of %d messages", len(b))
+	}
+	return fmt.Sprintf("%d of %d messages failed, first error: %s", n, len(b), first)
+}
+
+// Unwrap returns the errors of the batch.
+func (b BatchError) Unwrap() []error {
+	return b
+}
+
+// batchErrors returns the error of each of the n messages of a batch
+// from the error returned by OperateBatch.
+func batchErrors(err error, n int) []error {
+	errs := make([]error, n)
+	var be BatchError
+	if errors.As(err, &be) && len(be) == n {
+		copy(errs, be)
+		return errs
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// batching reports if messages are to be batched for ops, all of which
+// must be BatchOperators.
+func (m *MailboxOperator) batching(ops []Operator) bool {
+	if m.streaming {
+		return false
+	}
+	for _, op := range ops {
+		if _, ok := op.(BatchOperator); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// batch groups the mail on the reader chan into batches, sending each
+// over the batches chan once it holds batchSize messages or its first
+// message has waited batchLatency, until the reader chan is closed.
+func (m *MailboxOperator) batch(reader <-chan mailBytesId, batches chan<- []mailBytesId) {
+	defer close(batches)
+	timer := time.NewTimer(m.batchLatency)
+	timer.Stop()
+	var (
+		b       []mailBytesId
+		timeout <-chan time.Time
+	)
+	for {
+		select {
+		case mbi, ok := <-reader:
+			if !ok {
+				if len(b) > 0 {
+					batches <- b
+				}
+				return
+			}
+			b = append(b, mbi)
+			if len(b) == 1 {
+				timer.Reset(m.batchLatency)
+				timeout = timer.C
+			}
+			if len(b) < m.batchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timeout:
+		}
+		batches <- b
+		b, timeout = nil, nil
+	}
+}
+
+// operateBatch runs op on the batch b, unless processing is cancelled,
+// recording the result for each message.
+func (m *MailboxOperator) operateBatch(ctx context.Context, h *errorHandler, st *runStats, op BatchOperator, b []mailBytesId) {
+	msgs := make([]Message, len(b))
+	for i, mbi := range b {
+		msgs[i] = Message{mbi.m, mbi.buf.Bytes()}
+	}
+	var err error
+	reuse := true // the buffers may be reused, unless the call is abandoned
+	operated := ctx.Err() == nil
+	if operated {
+		st.gauge(MetricBusyWorkers, &st.busy, 1)
+		start := time.Now()
+		octx, span := m.tracer.Start(ctx, SpanOperate, Attribute{AttrBatchSize, len(b)})
+		if m.timeout <= 0 {
+			err = callBatch(op, msgs)
+		} else {
+			err = m.withTimeout(octx, func(context.Context) error {
+				return callBatch(op, msgs)
+			}, func() { reuse = false })
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+		m.metrics.Observe(MetricOperateSeconds, time.Since(start).Seconds(), b[0].m.Kind)
+		st.gauge(MetricBusyWorkers, &st.busy, -1)
+	}
+	stopped := false
+	for i, err := range batchErrors(err, len(b)) {
+		if errors.Is(err, ErrStop) {
+			if !stopped {
+				h.stop()
+				stopped = true
+			}
+			err = nil
+		}
+		m.finish(h, st, b[i], operated, msgs[i].Data, reuse, err)
+	}
+}
+
+// callBatch runs op on msgs, recovering any panic as a PanicError.
+func callBatch(op BatchOperator, msgs []Message) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack(), MailFile: msgs[0].MailFile}
+		}
+	}()
+	return op.OperateBatch(msgs)
+}
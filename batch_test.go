@@ -0,0 +1,138 @@
+package mailboxoperator
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// batcher is a BatchOperator recording the sizes of its batches, and
+// failing the koi8-r encoded message in the example maildir.
+type batcher struct {
+	sync.Mutex
+	sizes []int
+	fail  error // returned for whole batches, if set
+}
+
+func (b *batcher) Operate(r io.Reader) error {
+	return errors.New("Operate called on BatchOperator")
+}
+
+func (b *batcher) OperateBatch(msgs []Message) error {
+	b.Lock()
+	defer b.Unlock()
+	b.sizes = append(b.sizes, len(msgs))
+	if b.fail != nil {
+		return b.fail
+	}
+	errs := make(BatchError, len(msgs))
+	failed := false
+	for i, m := range msgs {
+		if bytes.Contains(m.Data, []byte("koi8-r")) {
+			errs[i] = errors.New("koi8-r")
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func TestProcessBatch(t *testing.T) {
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	b := &batcher{}
+	c := NewErrorCollector()
+	mo, err := NewMailboxOperator(mboxes, maildirs, b, c.Handle, WithBatchSize(4, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := mo.OperateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, n := range b.sizes {
+		if n < 1 || n > 4 {
+			t.Errorf("unexpected batch size %d", n)
+		}
+		total += n
+	}
+	if total != 9 || report.Operated != 9 || report.Errors != 1 {
+		t.Errorf("got %d messages in batches %v, report %+v", total, b.sizes, report.RunCounts)
+	}
+	errs := c.Errors()
+	var oe *OperationError
+	if len(errs) != 1 || !errors.As(errs[0], &oe) || oe.Kind != "maildir" || oe.Offset != 3 {
+		t.Errorf("expected one error at maildir offset 3, got %v", errs)
+	}
+
+	// an error for the whole batch applies to each message
+	b = &batcher{fail: errors.New("bulk insert failed")}
+	c = NewErrorCollector()
+	mo, err = NewMailboxOperator(nil, maildirs, b, c.Handle, WithBatchSize(4, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(c.Errors()), 6; got != want {
+		t.Errorf("got %d want %d errors", got, want)
+	}
+
+	// ErrStop stops processing without error
+	b = &batcher{fail: ErrStop}
+	mo, err = NewMailboxOperator(nil, maildirs, b, oeh, WithBatchSize(6, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = mo.OperateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors != 0 || len(b.sizes) != 1 {
+		t.Errorf("got batches %v, report %+v", b.sizes, report.RunCounts)
+	}
+}
+
+func TestBatchLatency(t *testing.T) {
+	m := &MailboxOperator{batchSize: 10, batchLatency: 10 * time.Millisecond}
+	reader := make(chan mailBytesId)
+	batches := make(chan []mailBytesId)
+	go m.batch(reader, batches)
+
+	// a partial batch is passed on after the maximum latency
+	reader <- mailBytesId{m: &mailfile.MailFile{No: 1}}
+	select {
+	case b := <-batches:
+		if len(b) != 1 {
+			t.Errorf("got batch of %d want 1", len(b))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("partial batch not passed on")
+	}
+
+	// a full batch is passed on at once, and the rest when the reader
+	// chan is closed
+	go func() {
+		for i := range 12 {
+			reader <- mailBytesId{m: &mailfile.MailFile{No: i}}
+		}
+		close(reader)
+	}()
+	sizes := []int{}
+	for b := range batches {
+		sizes = append(sizes, len(b))
+	}
+	if len(sizes) < 2 || sizes[0] != 10 {
+		t.Errorf("unexpected batch sizes %v", sizes)
+	}
+}
@@ -0,0 +1,78 @@
+package mailboxoperator
+
+// budget provides a limit on the bytes of messages held in memory
+// between the mailbox producers and the workers, together with a pool
+// of buffers for holding messages.
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// maxPooledBuffer is the largest buffer capacity returned to
+// bufferPool, to avoid retaining the memory of unusually large
+// messages.
+const maxPooledBuffer = 16 << 20
+
+// bufferPool holds buffers for reuse by producers.
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from bufferPool.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer resets b and returns it to bufferPool.
+func putBuffer(b *bytes.Buffer) {
+	if b == nil || b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// budget is a weighted semaphore bounding the bytes of messages in
+// flight. A nil budget is unbounded.
+type budget struct {
+	sem *semaphore.Weighted
+	max int64
+}
+
+// newBudget returns a budget of max bytes, or nil if max is not
+// positive.
+func newBudget(max int64) *budget {
+	if max <= 0 {
+		return nil
+	}
+	return &budget{
+		sem: semaphore.NewWeighted(max),
+		max: max,
+	}
+}
+
+// acquire blocks until n bytes of budget are available, returning the
+// bytes acquired. A message larger than the whole budget acquires the
+// whole budget.
+func (b *budget) acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	n = min(n, b.max)
+	_ = b.sem.Acquire(context.Background(), n)
+	return n
+}
+
+// release returns n bytes to the budget.
+func (b *budget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.sem.Release(n)
+}
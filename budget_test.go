@@ -0,0 +1,37 @@
+package mailboxoperator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	b := newBudget(10)
+
+	// a message larger than the budget acquires the whole budget
+	if got, want := b.acquire(25), int64(10); got != want {
+		t.Fatalf("acquired got %d want %d", got, want)
+	}
+
+	// further acquisitions block until the budget is released
+	done := make(chan int64)
+	go func() {
+		done <- b.acquire(4)
+	}()
+	select {
+	case <-done:
+		t.Fatal("acquire did not block on exhausted budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(10)
+	if got, want := <-done, int64(4); got != want {
+		t.Errorf("acquired got %d want %d", got, want)
+	}
+
+	// a nil budget is unbounded
+	var nb *budget
+	if got, want := nb.acquire(100), int64(0); got != want {
+		t.Errorf("nil budget acquired got %d want %d", got, want)
+	}
+	nb.release(0)
+}
@@ -8,28 +8,36 @@ package mailboxoperator
 
 import (
 	"errors"
-	"fmt"
+	"os"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
 )
 
+// ErrMessageTooLarge reports a message exceeding the maximum size set
+// by WithMaxMessageSize.
+var ErrMessageTooLarge error = mailfile.ErrMessageTooLarge
+
+// ErrStop may be returned by an Operator to stop processing early
+// without error, for example once a sought message has been found.
+// The mail in flight is completed, no further mail is passed to the
+// Operator and Operate returns nil. ErrStop is not passed to the
+// OperatorErrorHandler.
+var ErrStop error = errors.New("stop processing")
+
+// ReadError reports an error reading a mailbox part way through, such
+// as from a damaged compressed mbox. See WithSalvage.
+type ReadError = mailfile.ReadError
+
 // OperatorErrorHandler is a function type for dealing with errors from
 // mailboxes. Invocations returning a non-nil error will cause
 // mailboxoperator to terminate. User-supplied functions may be supplied.
 type OperatorErrorHandler func(error) error
 
-// OpErrPrintHandler prints errors and continues, unless the error is
-// not of the anticipated OperationError type.
-var OpErrPrintHandler OperatorErrorHandler = func(err error) error {
-	var mbo *OperationError
-	if errors.As(err, &mbo) {
-		// Kind   string // mbox or maildir
-		// Path   string // path to mbox or maildir
-		// Offset int    // email offset in mbox or maildir
-		// Err    error
-		fmt.Printf("%s: offset: %d error: %s\n", mbo.Path, mbo.Offset, mbo.Err)
-		return nil
-	}
-	return err
-}
+// OpErrPrintHandler prints errors to stdout and continues, unless the
+// error is not of the anticipated OperationError or SourceError types.
+// A mailbox which cannot be opened or read is skipped. See
+// NewPrintHandler for printing to another io.Writer.
+var OpErrPrintHandler OperatorErrorHandler = NewPrintHandler(os.Stdout)
 
 // OpErrFatalHandler always returns the error, if any.
 var OpErrFatalHandler OperatorErrorHandler = func(err error) error {
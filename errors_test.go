@@ -12,6 +12,11 @@ func TestOpErrPrintHandler(t *testing.T) {
 	if err != nil {
 		t.Fatalf("got non-nil err %s", err)
 	}
+	err = &SourceError{"a", "b", PhaseOpen, errors.New("test")}
+	err = OpErrPrintHandler(err)
+	if err != nil {
+		t.Fatalf("got non-nil err %s", err)
+	}
 	err = errors.New("non typed error")
 	err = OpErrPrintHandler(err)
 	if err == nil {
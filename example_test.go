@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	mbo "github.com/rorycl/mailboxoperator"
+	"github.com/rorycl/mailboxoperator/mailfile"
 )
 
 // counter is a simple struct with mutex protected int
@@ -56,3 +57,28 @@ func Example() {
 	fmt.Println(c.num)
 	// Output: 9
 }
+
+func ExampleMapReduce() {
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	// map each message to its subject, and count the subjects without
+	// locks, since reduce is called from a single goroutine
+	subject := func(mf *mailfile.MailFile, r io.Reader) (string, error) {
+		msg, err := mail.ReadMessage(r)
+		if err != nil {
+			return "", err
+		}
+		return msg.Header.Get("Subject"), nil
+	}
+	count := func(acc map[string]int, s string) map[string]int {
+		acc[s]++
+		return acc
+	}
+
+	subjects, err := mbo.MapReduce(mboxes, nil, subject, count, map[string]int{}, mbo.OpErrFatalHandler)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(len(subjects))
+	// Output: 3
+}
@@ -0,0 +1,269 @@
+package mailboxoperator
+
+// handlers provides OperatorErrorHandler constructors for collecting
+// errors, tolerating a threshold of errors and writing errors to an
+// io.Writer as text or JSON lines.
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrThresholdExceeded is wrapped by the error returned by a
+// ThresholdHandler once its threshold is exceeded.
+var ErrThresholdExceeded error = errors.New("error threshold exceeded")
+
+// NewPrintHandler returns an OperatorErrorHandler which writes errors
+// to w in the manner of OpErrPrintHandler, continuing unless the error
+// is not an OperationError or SourceError or cannot be written.
+func NewPrintHandler(w io.Writer) OperatorErrorHandler {
+	var mu sync.Mutex
+	return func(err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		var (
+			oe   *OperationError
+			se   *SourceError
+			werr error
+		)
+		switch {
+		case errors.As(err, &oe):
+			_, werr = fmt.Fprintf(w, "%s: offset: %d error: %s\n", oe.Path, oe.Offset, oe.Err)
+		case errors.As(err, &se):
+			_, werr = fmt.Fprintf(w, "%s: %s error: %s\n", se.Path, se.Phase, se.Err)
+		default:
+			return err
+		}
+		return werr
+	}
+}
+
+// errorRecord is the JSON encoding of an OperationError or SourceError.
+type errorRecord struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"` // operation or source
+	Kind   string    `json:"kind"` // mbox or maildir
+	Path   string    `json:"path"`
+	Offset *int      `json:"offset,omitempty"`
+	Phase  string    `json:"phase,omitempty"`
+	Error  string    `json:"error"`
+}
+
+// NewJSONHandler returns an OperatorErrorHandler which writes errors to
+// w as JSON lines, each an object with the time, type ("operation" or
+// "source"), kind, path, offset or phase and error message. Processing
+// continues unless the error is not an OperationError or SourceError or
+// cannot be written.
+func NewJSONHandler(w io.Writer) OperatorErrorHandler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(err error) error {
+		var (
+			oe  *OperationError
+			se  *SourceError
+			rec errorRecord
+		)
+		switch {
+		case errors.As(err, &oe):
+			rec = errorRecord{Type: "operation", Kind: oe.Kind, Path: oe.Path, Offset: &oe.Offset, Error: oe.Err.Error()}
+		case errors.As(err, &se):
+			rec = errorRecord{Type: "source", Kind: se.Kind, Path: se.Path, Phase: se.Phase, Error: se.Err.Error()}
+		default:
+			return err
+		}
+		rec.Time = time.Now()
+		mu.Lock()
+		defer mu.Unlock()
+		return enc.Encode(rec)
+	}
+}
+
+// ErrorSummary summarises the errors collected by an ErrorCollector
+// for a path and error message.
+type ErrorSummary struct {
+	Path    string
+	Err     string // the error message
+	Count   int
+	Offsets []int // email offsets of OperationErrors, in order
+}
+
+// ErrorCollector collects OperationErrors and SourceErrors passed to
+// its Handle method, which is an OperatorErrorHandler. It is safe for
+// concurrent use.
+type ErrorCollector struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+// NewErrorCollector returns an empty ErrorCollector.
+func NewErrorCollector() *ErrorCollector {
+	return &ErrorCollector{}
+}
+
+// Handle collects OperationErrors and SourceErrors, continuing
+// processing. Other errors are returned.
+func (c *ErrorCollector) Handle(err error) error {
+	var (
+		oe *OperationError
+		se *SourceError
+	)
+	if !errors.As(err, &oe) && !errors.As(err, &se) {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+	return nil
+}
+
+// Errors returns the errors collected, in the order received.
+func (c *ErrorCollector) Errors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.errs)
+}
+
+// Summary returns the errors collected grouped by path and error
+// message, ordered by path and message.
+func (c *ErrorCollector) Summary() []ErrorSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	type key struct{ path, err string }
+	groups := map[key]*ErrorSummary{}
+	for _, err := range c.errs {
+		var (
+			k      key
+			offset = -1
+			oe     *OperationError
+			se     *SourceError
+		)
+		if errors.As(err, &oe) {
+			k, offset = key{oe.Path, oe.Err.Error()}, oe.Offset
+		} else if errors.As(err, &se) {
+			k = key{se.Path, se.Err.Error()}
+		}
+		s, ok := groups[k]
+		if !ok {
+			s = &ErrorSummary{Path: k.path, Err: k.err}
+			groups[k] = s
+		}
+		s.Count++
+		if offset >= 0 {
+			s.Offsets = append(s.Offsets, offset)
+		}
+	}
+	summary := make([]ErrorSummary, 0, len(groups))
+	for _, s := range groups {
+		slices.Sort(s.Offsets)
+		summary = append(summary, *s)
+	}
+	slices.SortFunc(summary, func(a, b ErrorSummary) int {
+		return cmp.Or(cmp.Compare(a.Path, b.Path), cmp.Compare(a.Err, b.Err))
+	})
+	return summary
+}
+
+// ThresholdHandler tolerates OperationErrors and SourceErrors until a
+// maximum number of errors, or a maximum rate of errors per operation,
+// is exceeded. The rate is only checked once minOps operations have
+// been counted by an Operator wrapped with Wrap. It is safe for
+// concurrent use.
+type ThresholdHandler struct {
+	maxErrors int
+	maxRate   float64
+	minOps    int
+	mu        sync.Mutex
+	errs      int
+	ops       int
+}
+
+// NewThresholdHandler returns a ThresholdHandler failing after more
+// than maxErrors errors or, once minOps operations have been made, an
+// error rate above maxRate, a fraction of the operations. A zero
+// maxErrors or maxRate sets no limit.
+func NewThresholdHandler(maxErrors int, maxRate float64, minOps int) *ThresholdHandler {
+	return &ThresholdHandler{
+		maxErrors: maxErrors,
+		maxRate:   maxRate,
+		minOps:    minOps,
+	}
+}
+
+// Handle counts OperationErrors and SourceErrors, returning an error
+// wrapping ErrThresholdExceeded and the error once the threshold is
+// exceeded. Other errors are returned.
+func (t *ThresholdHandler) Handle(err error) error {
+	var (
+		oe *OperationError
+		se *SourceError
+	)
+	if !errors.As(err, &oe) && !errors.As(err, &se) {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.errs++
+	if t.maxErrors > 0 && t.errs > t.maxErrors {
+		return fmt.Errorf("%w: %d errors: %w", ErrThresholdExceeded, t.errs, err)
+	}
+	if t.maxRate > 0 && t.ops >= t.minOps && t.ops > 0 {
+		if rate := float64(t.errs) / float64(t.ops); rate > t.maxRate {
+			return fmt.Errorf("%w: %d errors in %d operations: %w", ErrThresholdExceeded, t.errs, t.ops, err)
+		}
+	}
+	return nil
+}
+
+// Wrap returns an Operator counting the operations of op, for checking
+// the error rate. A MailboxOperator calls op in place of the returned
+// Operator, so that the optional interfaces of op, such as
+// ContextOperator and BatchOperator, are used, and counts each message
+// operated on for the ThresholdHandler.
+func (t *ThresholdHandler) Wrap(op Operator) Operator {
+	return &countingOperator{op: op, t: t}
+}
+
+// count counts an operation.
+func (t *ThresholdHandler) count() {
+	t.mu.Lock()
+	t.ops++
+	t.mu.Unlock()
+}
+
+// countingOperator counts operations for a ThresholdHandler.
+type countingOperator struct {
+	op Operator
+	t  *ThresholdHandler
+}
+
+// Operate counts the operation and runs the wrapped Operator.
+func (c *countingOperator) Operate(r io.Reader) error {
+	c.t.count()
+	return c.op.Operate(r)
+}
+
+// unwrapCounting returns ops with the Operators wrapped by
+// ThresholdHandler.Wrap unwrapped, and the ThresholdHandlers counting
+// their operations.
+func unwrapCounting(ops []Operator) ([]Operator, []*ThresholdHandler) {
+	unwrapped := make([]Operator, len(ops))
+	var counters []*ThresholdHandler
+	for i, op := range ops {
+		c, ok := op.(*countingOperator)
+		for ok {
+			if !slices.Contains(counters, c.t) {
+				counters = append(counters, c.t)
+			}
+			op = c.op
+			c, ok = op.(*countingOperator)
+		}
+		unwrapped[i] = op
+	}
+	return unwrapped, counters
+}
@@ -0,0 +1,190 @@
+package mailboxoperator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPrintHandler(t *testing.T) {
+	var b bytes.Buffer
+	h := NewPrintHandler(&b)
+	if err := h(&OperationError{"mbox", "a", 3, errors.New("test")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h(&SourceError{"maildir", "b", PhaseOpen, errors.New("test")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h(errors.New("non typed error")); err == nil {
+		t.Fatal("got unexpected nil err")
+	}
+	if got, want := b.String(), "a: offset: 3 error: test\nb: open error: test\n"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var b bytes.Buffer
+	h := NewJSONHandler(&b)
+	if err := h(&OperationError{"mbox", "a", 3, errors.New("test")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h(&SourceError{"maildir", "b", PhaseRead, errors.New("test")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h(errors.New("non typed error")); err == nil {
+		t.Fatal("got unexpected nil err")
+	}
+
+	var got []map[string]any
+	scanner := bufio.NewScanner(&b)
+	for scanner.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rec["time"]; !ok {
+			t.Error("time not recorded")
+		}
+		delete(rec, "time")
+		got = append(got, rec)
+	}
+	want := []map[string]any{
+		{"type": "operation", "kind": "mbox", "path": "a", "offset": 3.0, "error": "test"},
+		{"type": "source", "kind": "maildir", "path": "b", "phase": "read", "error": "test"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("records mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestErrorCollector(t *testing.T) {
+	var s simple
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/empty"}
+
+	c := NewErrorCollector()
+	mo, err := NewMailboxOperator(mboxes, maildirs, &s, c.Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(c.Errors()), 2; got != want {
+		t.Fatalf("got %d want %d errors", got, want)
+	}
+
+	_ = c.Handle(&OperationError{"maildir", "maildir/testdata/example/cur/1735238277.2023287_9.example_2_s", 1, errors.New(`charset not supported: "koi8-r"`)})
+	if err := c.Handle(errors.New("non typed error")); err == nil {
+		t.Fatal("got unexpected nil err")
+	}
+	want := []ErrorSummary{
+		{
+			Path:  "maildir/testdata/example/cur/1735238277.2023287_9.example_2_s",
+			Err:   `charset not supported: "koi8-r"`,
+			Count: 2, Offsets: []int{1, 3},
+		},
+		{
+			Path:  "mbox/testdata/empty",
+			Err:   "mbox/testdata/empty is an empty mailbox: EOF",
+			Count: 1,
+		},
+	}
+	if diff := cmp.Diff(want, c.Summary()); diff != "" {
+		t.Errorf("summary mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// nop is an Operator which does nothing.
+type nop struct{}
+
+func (nop) Operate(io.Reader) error { return nil }
+
+func TestThresholdHandler(t *testing.T) {
+	opErr := &OperationError{"mbox", "a", 3, errors.New("test")}
+
+	// error count
+	th := NewThresholdHandler(2, 0, 0)
+	for i := range 2 {
+		if err := th.Handle(opErr); err != nil {
+			t.Fatalf("error %d: unexpected %v", i, err)
+		}
+	}
+	err := th.Handle(opErr)
+	if !errors.Is(err, ErrThresholdExceeded) || !errors.Is(err, opErr) {
+		t.Fatalf("expected ErrThresholdExceeded, got %v", err)
+	}
+	if err := th.Handle(errors.New("non typed error")); errors.Is(err, ErrThresholdExceeded) {
+		t.Fatal("non typed error should be returned as is")
+	}
+
+	// error rate, checked after 10 operations
+	th = NewThresholdHandler(0, 0.3, 10)
+	op := th.Wrap(nop{})
+	for range 3 {
+		if err := th.Handle(opErr); err != nil {
+			t.Fatalf("rate checked before minimum operations: %v", err)
+		}
+	}
+	for range 15 {
+		_ = op.Operate(strings.NewReader(""))
+	}
+	if err := th.Handle(opErr); err != nil {
+		t.Fatalf("4 errors in 15 operations: unexpected %v", err)
+	}
+	if err := th.Handle(opErr); !errors.Is(err, ErrThresholdExceeded) {
+		t.Fatalf("5 errors in 15 operations: expected ErrThresholdExceeded, got %v", err)
+	}
+
+	// the handler stops processing
+	var s simple
+	th = NewThresholdHandler(0, 0.01, 1)
+	mo, err := NewMailboxOperator(nil, []string{"maildir/testdata/example/"}, th.Wrap(&s), th.Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); !errors.Is(err, ErrThresholdExceeded) {
+		t.Fatalf("expected ErrThresholdExceeded, got %v", err)
+	}
+
+	// the optional interfaces of a wrapped Operator are used, and its
+	// operations counted: one of the six messages fails
+	for _, tt := range []struct {
+		maxRate float64
+		want    error
+	}{
+		{0.5, nil},
+		{0.1, ErrThresholdExceeded},
+	} {
+		b := &batcher{}
+		th = NewThresholdHandler(0, tt.maxRate, 1)
+		mo, err := NewMailboxOperator(nil, []string{"maildir/testdata/example/"}, th.Wrap(b), th.Handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); !errors.Is(err, tt.want) {
+			t.Errorf("rate %g: got %v want %v", tt.maxRate, err, tt.want)
+		}
+		if len(b.sizes) == 0 {
+			t.Errorf("rate %g: OperateBatch not called", tt.maxRate)
+		}
+	}
+	h := newHooked()
+	mo, err = NewMailboxOperator(nil, []string{"maildir/testdata/example/"}, th.Wrap(h), th.Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mo.OperateReport(); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.inits) != WorkersNum || len(h.starts) != 1 {
+		t.Errorf("got %d inits and %d starts of wrapped Operator", len(h.inits), len(h.starts))
+	}
+}
@@ -0,0 +1,85 @@
+package mailboxoperator
+
+// lifecycle provides optional hooks called as workers start and stop
+// and as each mailbox is started and finished.
+
+import (
+	"fmt"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// WorkerOperator is an Operator with hooks called by each of the
+// WorkersNum worker goroutines, with ids from 0, before it first calls
+// the Operator and after it last does, such as to open and commit a
+// per-worker transaction. An error from WorkerInit stops processing.
+// WorkerDone is only called if WorkerInit succeeded, and an error from
+// it is passed to the OperatorErrorHandler. Both errors are reported
+// as a WorkerError.
+type WorkerOperator interface {
+	Operator
+	WorkerInit(id int) error
+	WorkerDone(id int) error
+}
+
+// SourceOperator is an Operator with hooks called as each mailbox is
+// started and finished. SourceStart is passed a MailFile with the kind
+// and path of the mailbox before its first message is read. SourceEnd
+// is called once the Operator has finished with the last message of
+// the mailbox, with the count of messages passed to the Operator and
+// the error which stopped the mailbox being read to the end, if any,
+// or context.Canceled if processing stopped first. If the mailbox was
+// read to the end past errors skipped by the OperatorErrorHandler, the
+// error is the last of them. Mailboxes which cannot be opened are not
+// started. The hooks of different mailboxes may be called
+// concurrently.
+type SourceOperator interface {
+	Operator
+	SourceStart(mf *mailfile.MailFile)
+	SourceEnd(path string, count int, err error)
+}
+
+// WorkerError is a decorated error describing the worker and phase of
+// an error from a WorkerOperator hook.
+type WorkerError struct {
+	ID    int    // worker id
+	Phase string // PhaseWorkerInit or PhaseWorkerDone
+	Err   error
+}
+
+// The phases of a worker in which a WorkerError may occur.
+const (
+	PhaseWorkerInit = "init" // WorkerInit
+	PhaseWorkerDone = "done" // WorkerDone
+)
+
+func (w *WorkerError) Error() string {
+	return fmt.Sprintf("worker:%d phase:%s error: %s", w.ID, w.Phase, w.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (w *WorkerError) Unwrap() error {
+	return w.Err
+}
+
+// sourceState tracks the completion of a source for SourceEnd.
+type sourceState struct {
+	produced bool  // all messages have been read
+	err      error // the error stopping reading, if any
+	ended    bool  // SourceEnd has been called
+}
+
+// ending reports if source i has just been finished with, once all its
+// messages have been read and processed. It is called with r locked.
+func (r *runStats) ending(i int) bool {
+	if r.hooks == nil {
+		return false
+	}
+	ss := &r.ends[i]
+	sr := r.sources[i]
+	if ss.ended || !ss.produced || sr.Operated+sr.Skipped < sr.Read {
+		return false
+	}
+	ss.ended = true
+	return true
+}
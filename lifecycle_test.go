@@ -0,0 +1,218 @@
+package mailboxoperator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// hooked is a WorkerOperator and SourceOperator recording its hooks.
+type hooked struct {
+	sync.Mutex
+	initErr   error // returned by WorkerInit for worker 0
+	inits     map[int]int
+	dones     map[int]int
+	starts    map[string]string
+	ends      map[string]int
+	endErrs   map[string]error
+	operated  int
+	atEnd     int // messages operated when the last source ended
+	lateEnded bool
+}
+
+func newHooked() *hooked {
+	return &hooked{
+		inits:   map[int]int{},
+		dones:   map[int]int{},
+		starts:  map[string]string{},
+		ends:    map[string]int{},
+		endErrs: map[string]error{},
+	}
+}
+
+func (h *hooked) Operate(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	h.Lock()
+	defer h.Unlock()
+	h.operated++
+	return err
+}
+
+func (h *hooked) WorkerInit(id int) error {
+	h.Lock()
+	defer h.Unlock()
+	h.inits[id]++
+	if id == 0 {
+		return h.initErr
+	}
+	return nil
+}
+
+func (h *hooked) WorkerDone(id int) error {
+	h.Lock()
+	defer h.Unlock()
+	h.dones[id]++
+	return nil
+}
+
+func (h *hooked) SourceStart(mf *mailfile.MailFile) {
+	h.Lock()
+	defer h.Unlock()
+	h.starts[mf.Path] = mf.Kind
+}
+
+func (h *hooked) SourceEnd(path string, count int, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.starts[path]; !ok {
+		h.lateEnded = true
+	}
+	h.ends[path] = count
+	h.endErrs[path] = err
+	h.atEnd = h.operated
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/missing.mbox"}
+	maildirs := []string{"maildir/testdata/example/"}
+
+	for _, streaming := range []bool{false, true} {
+		h := newHooked()
+		var opts []Option
+		if streaming {
+			opts = append(opts, WithStreaming())
+		}
+		mo, err := NewMailboxOperator(mboxes, maildirs, h, NewErrorCollector().Handle, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatal(err)
+		}
+		if len(h.inits) != WorkersNum || len(h.dones) != WorkersNum {
+			t.Errorf("streaming %t: got %d inits and %d dones for %d workers", streaming, len(h.inits), len(h.dones), WorkersNum)
+		}
+		for id := range WorkersNum {
+			if h.inits[id] != 1 || h.dones[id] != 1 {
+				t.Errorf("streaming %t: worker %d got %d inits, %d dones", streaming, id, h.inits[id], h.dones[id])
+			}
+		}
+		wantStarts := map[string]string{
+			"mbox/testdata/golang.mbox": "mbox",
+			"maildir/testdata/example/": "maildir",
+		}
+		if diff := cmp.Diff(wantStarts, h.starts); diff != "" {
+			t.Errorf("streaming %t: starts diff %s", streaming, diff)
+		}
+		wantEnds := map[string]int{
+			"mbox/testdata/golang.mbox": 2,
+			"maildir/testdata/example/": 6,
+		}
+		if diff := cmp.Diff(wantEnds, h.ends); diff != "" {
+			t.Errorf("streaming %t: ends diff %s", streaming, diff)
+		}
+		for path, err := range h.endErrs {
+			if err != nil {
+				t.Errorf("streaming %t: %s ended with %v", streaming, path, err)
+			}
+		}
+		if h.lateEnded || h.atEnd != 8 {
+			t.Errorf("streaming %t: last source ended after %d of 8 messages", streaming, h.atEnd)
+		}
+	}
+}
+
+func TestLifecycleWorkerInitErr(t *testing.T) {
+	maildirs := []string{"maildir/testdata/example/"}
+	initErr := errors.New("no database")
+
+	h := newHooked()
+	h.initErr = initErr
+	mo, err := NewMailboxOperator(nil, maildirs, h, NewErrorCollector().Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mo.Operate()
+	var we *WorkerError
+	if !errors.Is(err, initErr) || !errors.As(err, &we) || we.ID != 0 || we.Phase != PhaseWorkerInit {
+		t.Fatalf("expected worker 0 init error, got %v", err)
+	}
+	if h.dones[0] != 0 || len(h.dones) != WorkersNum-1 {
+		t.Errorf("got dones %v, expected none for worker 0", h.dones)
+	}
+	path := maildirs[0]
+	if got := h.endErrs[path]; got != nil && !errors.Is(got, context.Canceled) {
+		t.Errorf("source ended with %v", got)
+	}
+}
+
+func TestLifecycleFactoryHooks(t *testing.T) {
+	mboxes := []string{"mbox/testdata/golang.mbox"}
+	maildirs := []string{"maildir/testdata/example/"}
+
+	// the factory is only called for the workers, so may index a
+	// slice by worker id
+	h := newHooked()
+	states := make([]*unlocked, WorkersNum)
+	factory := func(id int) Operator {
+		states[id] = &unlocked{id: id}
+		return states[id]
+	}
+	mo, err := NewMailboxOperatorWithFactory(mboxes, maildirs, factory, nil, NewErrorCollector().Handle, WithSourceHooks(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, u := range states {
+		total += u.num
+	}
+	if total != 8 {
+		t.Errorf("got %d want 8 messages", total)
+	}
+	wantEnds := map[string]int{
+		"mbox/testdata/golang.mbox": 2,
+		"maildir/testdata/example/": 6,
+	}
+	if diff := cmp.Diff(wantEnds, h.ends); diff != "" {
+		t.Errorf("ends diff %s", diff)
+	}
+	if h.operated != 0 || len(h.inits) != 0 {
+		t.Errorf("hooks Operator operated %d messages in %d workers", h.operated, len(h.inits))
+	}
+}
+
+func TestLifecycleSkippedReadErr(t *testing.T) {
+	// a maildir with a message which cannot be opened
+	broken := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(broken, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(broken, "missing"), filepath.Join(broken, "cur", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHooked()
+	mo, err := NewMailboxOperator(nil, []string{broken}, h, NewErrorCollector().Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.endErrs[broken]; !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("source ended with %v, expected the skipped read error", err)
+	}
+}
@@ -16,13 +16,27 @@
 //		fmt.Println(m.Path)
 //	   // do something with the io.Reader in r
 //	}
+//
+// or, iterating over the mails:
+//
+//	for m, r := range md.Messages() {
+//		fmt.Println(m.Path)
+//		// do something with the io.Reader in r
+//	}
+//	if err := md.Err(); err != nil {
+//		...
+//	}
 package maildir
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
+	"log/slog"
 	"os"
 	"path/filepath"
 
@@ -40,15 +54,50 @@ var ErrEmptyMailDir error = errors.New("maildir is empty")
 // subdirectories (expected to be mailDirContents) and a listing of the
 // Mail items (if any) in each subdirectory.
 type MailDir struct {
-	Path     string
-	Contents []*mailfile.MailFile
-	stats    map[string]int
-	current  int // current message being read
+	Path        string
+	Contents    []*mailfile.MailFile
+	stats       map[string]int
+	current     int // current message being read
+	headersOnly bool
+	maxSize     int64
+	logger      *slog.Logger
+	err         error // the error stopping Messages, if any
+}
+
+// Option configures a MailDir.
+type Option func(*MailDir)
+
+// WithHeadersOnly sets NextReader to provide only the header block of
+// each mail, up to and including the first empty line. Each file is
+// closed once its headers have been read.
+func WithHeadersOnly() Option {
+	return func(m *MailDir) {
+		m.headersOnly = true
+	}
+}
+
+// WithMaxMessageSize limits mails to n bytes. Reads beyond the limit
+// return mailfile.ErrMessageTooLarge.
+func WithMaxMessageSize(n int64) Option {
+	return func(m *MailDir) {
+		m.maxSize = n
+	}
+}
+
+// WithLogger sets the logger recording, at debug level, the listing of
+// the maildir and the end of reading it. By default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(m *MailDir) {
+		m.logger = l
+	}
 }
 
 // NewMailDir sets up a mail directory for listing the contents.
-func NewMailDir(path string) (*MailDir, error) {
+func NewMailDir(path string, opts ...Option) (*MailDir, error) {
 	m := MailDir{}
+	for _, o := range opts {
+		o(&m)
+	}
 	_, err := os.Stat(path)
 	if errors.Is(err, fs.ErrNotExist) {
 		return &m, err
@@ -56,7 +105,12 @@ func NewMailDir(path string) (*MailDir, error) {
 	m.Path = path
 	m.stats = map[string]int{}
 	m.current = -1
+	if m.logger == nil {
+		m.logger = slog.New(slog.DiscardHandler)
+	}
+	m.logger = m.logger.With("kind", "maildir", "path", path)
 	err = m.list()
+	m.logger.Debug("maildir opened", "cur", m.stats["cur"], "new", m.stats["new"], "tmp", m.stats["tmp"])
 	if m.TotalEmails() == 0 {
 		return &m, ErrEmptyMailDir
 	}
@@ -111,6 +165,9 @@ func (m *MailDir) Next() (*mailfile.MailFile, error) {
 // metadata and io.Reader unless the contents are exhausted.
 func (m *MailDir) NextReader() (*mailfile.MailFile, io.Reader, error) {
 	m.current++
+	if m.current == len(m.Contents) && m.logger != nil {
+		m.logger.Debug("maildir read", "messages", len(m.Contents))
+	}
 	if m.current > len(m.Contents)-1 {
 		return nil, nil, io.EOF
 	}
@@ -118,11 +175,88 @@ func (m *MailDir) NextReader() (*mailfile.MailFile, io.Reader, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("file opening error %w", err)
 	}
+	var r io.Reader = f
+	if m.maxSize > 0 {
+		r = mailfile.LimitReader(f, m.maxSize)
+	}
+	if m.headersOnly {
+		defer func() {
+			_ = f.Close()
+		}()
+		headers, err := readHeaders(r)
+		if errors.Is(err, mailfile.ErrMessageTooLarge) {
+			return m.Contents[m.current], mailfile.TruncatedReader(bytes.NewReader(headers)), nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("header reading error %w", err)
+		}
+		return m.Contents[m.current], bytes.NewReader(headers), nil
+	}
+	if m.maxSize > 0 {
+		// retain the file as an io.Closer
+		return m.Contents[m.current], struct {
+			io.Reader
+			io.Closer
+		}{r, f}, nil
+	}
 	return m.Contents[m.current], io.Reader(f), nil
 }
 
+// Messages returns an iterator over the mails of the MailDir from the
+// next to be read by NextReader. Each reader is only valid until the
+// iteration continues, when its file is closed. Iteration stops at the
+// first error opening or reading a mail, which is reported by Err.
+func (m *MailDir) Messages() iter.Seq2[*mailfile.MailFile, io.Reader] {
+	return func(yield func(*mailfile.MailFile, io.Reader) bool) {
+		for {
+			mf, r, err := m.NextReader()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				m.err = err
+				return
+			}
+			more := yield(mf, r)
+			if c, ok := r.(io.Closer); ok {
+				_ = c.Close()
+			}
+			if !more {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error which stopped the iterator returned by
+// Messages, if any.
+func (m *MailDir) Err() error {
+	return m.err
+}
+
+// readHeaders reads the header block of a mail, up to and including
+// the first empty line, or all of r if there is no empty line.
+func readHeaders(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var headers []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		headers = append(headers, line...)
+		if err == io.EOF {
+			return headers, nil
+		}
+		if err != nil {
+			return headers, err
+		}
+		if len(bytes.Trim(line, "\r\n")) == 0 {
+			return headers, nil
+		}
+	}
+}
+
 // Reset sets the MailDir internal pointer back to -1 to re-read the
-// contents of the directories for Next() or NextReader().
+// contents of the directories for Next(), NextReader() or Messages().
 func (m *MailDir) Reset() {
 	m.current = -1
+	m.err = nil
 }
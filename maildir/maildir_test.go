@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"io/fs"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/mailboxoperator/mailfile"
 )
 
 func TestMailDir(t *testing.T) {
@@ -100,3 +102,78 @@ func TestMailDirEmpty(t *testing.T) {
 		t.Fatal("expected empty error")
 	}
 }
+
+func TestMailDirHeadersOnly(t *testing.T) {
+	md, err := NewMailDir("testdata/example", WithHeadersOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := 0
+	for {
+		m, r, err := md.NextReader()
+		if err != nil && err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(contents), "\n\n") {
+			t.Errorf("%s headers do not end with an empty line", m.Path)
+		}
+		if strings.Count(string(contents), "\n\n") != 1 {
+			t.Errorf("%s headers include body content", m.Path)
+		}
+		counter++
+	}
+	if got, want := counter, 6; got != want {
+		t.Errorf("count got %d want %d", got, want)
+	}
+}
+
+func TestMailDirMessages(t *testing.T) {
+	md, err := NewMailDir("testdata/example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for m, r := range md.Messages() {
+		if _, err := io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, m.Path)
+	}
+	if err := md.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(paths), 6; got != want {
+		t.Errorf("got %d want %d mails", got, want)
+	}
+
+	// breaking leaves the remaining mails for NextReader
+	md.Reset()
+	for range md.Messages() {
+		break
+	}
+	m, _, err := md.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Path, paths[1]; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+
+	// a mail which cannot be opened stops iteration
+	md.Reset()
+	md.Contents[2] = &mailfile.MailFile{Kind: "maildir", Path: "testdata/missing", No: 2}
+	n := 0
+	for range md.Messages() {
+		n++
+	}
+	if n != 2 || !errors.Is(md.Err(), fs.ErrNotExist) {
+		t.Errorf("got %d mails and error %v", n, md.Err())
+	}
+}
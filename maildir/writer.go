@@ -0,0 +1,87 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MailDirWriter writes mails to a new maildir.
+type MailDirWriter struct {
+	Path     string
+	hostname string
+	ids      map[string]struct{}
+	n        int // delivery count, for unique file names
+	sync.Mutex
+}
+
+// NewMailDirWriter makes a new maildir at path with the cur, new and
+// tmp subdirectories.
+func NewMailDirWriter(path string) (*MailDirWriter, error) {
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("directory %s already exists", path)
+	}
+	for _, md := range mailDirContents {
+		if err := os.MkdirAll(filepath.Join(path, md), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	m := &MailDirWriter{
+		Path:     path,
+		hostname: hostname,
+		ids:      map[string]struct{}{},
+	}
+	return m, nil
+}
+
+// Add writes the contents of r as a mail in the new subdirectory,
+// writing it first to tmp. The file modification time is set to date.
+// The from address is not used, but is accepted for compatibility with
+// mbox.MboxWriter. Messages with ids that have already been written are
+// not written again. Add returns a bool indicating if the message was
+// written or error.
+func (m *MailDirWriter) Add(from string, date time.Time, messageId string, r io.Reader) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.ids[messageId]; ok {
+		return false, nil
+	}
+	m.n++
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), os.Getpid(), m.n, m.hostname)
+	tmp := filepath.Join(m.Path, "tmp", name)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return false, fmt.Errorf("maildirwriter create error: %w", err)
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return false, fmt.Errorf("maildirwriter write error: %w", err)
+	}
+	if !date.IsZero() {
+		_ = os.Chtimes(tmp, date, date)
+	}
+	if err := os.Rename(tmp, filepath.Join(m.Path, "new", name)); err != nil {
+		return false, fmt.Errorf("maildirwriter delivery error: %w", err)
+	}
+	m.ids[messageId] = struct{}{}
+	return true, nil
+}
+
+// Close is provided for compatibility with mbox.MboxWriter. Each mail
+// is complete once added.
+func (m *MailDirWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package maildir
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailDirWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine")
+	m, err := NewMailDirWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2015, 1, 1, 1, 1, 1, 0, time.UTC)
+	mails := []struct {
+		id      string
+		body    string
+		written bool
+	}{
+		{"1", "Subject: one\n\nfirst\n", true},
+		{"2", "Subject: two\n\nsecond\n", true},
+		{"1", "Subject: one\n\nduplicate\n", false},
+	}
+	for i, mail := range mails {
+		ok, err := m.Add("test@example.com", date, mail.id, strings.NewReader(mail.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != mail.written {
+			t.Errorf("mail %d: got written %t want %t", i, ok, mail.written)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the written mails can be read back
+	md, err := NewMailDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md.TotalEmails(), 2; got != want {
+		t.Fatalf("got %d want %d mails", got, want)
+	}
+	got := []string{}
+	for {
+		mf, r, err := md.NextReader()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.(io.Closer).Close()
+		got = append(got, string(b))
+		fi, err := os.Stat(mf.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(date) {
+			t.Errorf("got modification time %s want %s", fi.ModTime(), date)
+		}
+	}
+	if len(got) != 2 || !strings.Contains(strings.Join(got, ""), "second") {
+		t.Errorf("unexpected mails %q", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(path, "tmp")); len(entries) != 0 {
+		t.Errorf("tmp not empty: %v", entries)
+	}
+}
+
+func TestFailMailDirWriter(t *testing.T) {
+	_, err := NewMailDirWriter(t.TempDir())
+	if err == nil {
+		t.Fatal("expected NewMailDirWriter to fail with existing directory")
+	}
+}
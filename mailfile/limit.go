@@ -0,0 +1,56 @@
+package mailfile
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrMessageTooLarge is returned when reading a message beyond a
+// maximum message size.
+var ErrMessageTooLarge error = errors.New("message exceeds maximum size")
+
+// LimitReader returns a reader providing the first n bytes of r,
+// returning ErrMessageTooLarge rather than io.EOF if r holds more than
+// n bytes.
+func LimitReader(r io.Reader, n int64) io.Reader {
+	return &limitReader{r: r, n: n}
+}
+
+// limitReader is an io.Reader which errors after n bytes.
+type limitReader struct {
+	r io.Reader
+	n int64 // bytes remaining
+}
+
+// Read reads up to the limit, after which it checks for further data.
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		if n, err := io.ReadFull(l.r, b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrMessageTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// TruncatedReader returns a reader providing the contents of r, a
+// message truncated at a maximum message size, followed by
+// ErrMessageTooLarge.
+func TruncatedReader(r io.Reader) io.Reader {
+	return io.MultiReader(r, tooLargeReader{})
+}
+
+// tooLargeReader is an io.Reader which always returns
+// ErrMessageTooLarge.
+type tooLargeReader struct{}
+
+// Read returns ErrMessageTooLarge.
+func (tooLargeReader) Read(p []byte) (int, error) {
+	return 0, ErrMessageTooLarge
+}
@@ -0,0 +1,44 @@
+package mailfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLimitReader(t *testing.T) {
+	tests := []struct {
+		contents string
+		limit    int64
+		want     string
+		err      error
+	}{
+		{"abcdef", 10, "abcdef", nil},
+		{"abcdef", 6, "abcdef", nil},
+		{"abcdef", 5, "abcde", ErrMessageTooLarge},
+		{"", 5, "", nil},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			got, err := io.ReadAll(LimitReader(strings.NewReader(tt.contents), tt.limit))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err got %v want %v", err, tt.err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncatedReader(t *testing.T) {
+	got, err := io.ReadAll(TruncatedReader(strings.NewReader("abc")))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("err got %v want %v", err, ErrMessageTooLarge)
+	}
+	if string(got) != "abc" {
+		t.Errorf("got %q want %q", got, "abc")
+	}
+}
@@ -0,0 +1,21 @@
+package mailfile
+
+import "fmt"
+
+// ReadError reports an error reading a mailbox part way through, such
+// as a CRC error or unexpected end of a damaged compressed mbox. Byte
+// offsets are in the uncompressed mailbox.
+type ReadError struct {
+	Offset   int64 // byte offset of the message being read
+	Position int64 // byte offset at which the error occurred
+	Err      error
+}
+
+func (r *ReadError) Error() string {
+	return fmt.Sprintf("read error at byte %d in message at byte %d: %s", r.Position, r.Offset, r.Err)
+}
+
+// Unwrap returns the underlying error.
+func (r *ReadError) Unwrap() error {
+	return r.Err
+}
@@ -0,0 +1,93 @@
+package mailboxoperator
+
+// mapreduce provides a typed alternative to an Operator, mapping each
+// message to a value on the workers and reducing the values in a
+// single goroutine.
+
+import (
+	"context"
+	"io"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// MapFunc maps the message mf, read from r, to a value. Returning an
+// error reports it to the OperatorErrorHandler as an OperationError,
+// and the message is not reduced. Returning ErrStop stops processing.
+type MapFunc[T any] func(mf *mailfile.MailFile, r io.Reader) (T, error)
+
+// ReduceFunc combines a value mapped from a message into the result so
+// far.
+type ReduceFunc[T, R any] func(acc R, v T) R
+
+// MapReduce maps each message in the mailboxes to a value with mapFn,
+// run by the WorkersNum worker goroutines in the manner of an Operator,
+// and combines the values with reduce, starting from init. reduce is
+// called from a single goroutine, so neither function needs locks to
+// build the result. Errors are handled by oeh, and options apply as to
+// NewMailboxOperator. The result of the messages reduced before
+// processing stopped is returned with the error stopping it, if any.
+func MapReduce[T, R any](mboxes, maildirs []string, mapFn MapFunc[T], reduce ReduceFunc[T, R], init R, oeh OperatorErrorHandler, opts ...Option) (R, error) {
+	results := make(chan T)
+	mo, err := NewMailboxOperator(mboxes, maildirs, &mapOperator[T]{mapFn, results}, oeh, opts...)
+	if err != nil {
+		return init, err
+	}
+
+	done := make(chan struct{})
+	reduced := make(chan R)
+	go func() {
+		acc := init
+		for {
+			select {
+			case v := <-results:
+				acc = reduce(acc, v)
+			case <-done:
+				reduced <- acc
+				return
+			}
+		}
+	}()
+	err = mo.Operate()
+	close(done)
+	return <-reduced, err
+}
+
+// mapOperator is an Operator sending the values mapped from each
+// message to the reducer over the results chan.
+type mapOperator[T any] struct {
+	mapFn   MapFunc[T]
+	results chan<- T
+}
+
+// Operate maps a message without its MailFile. call uses
+// operateMailFile instead.
+func (m *mapOperator[T]) Operate(r io.Reader) error {
+	return m.operateMailFile(context.Background(), nil, r)
+}
+
+// operateMailFile maps the message mf read from r, sending the value
+// to the reducer unless ctx is done first, such as when a call is
+// abandoned after a timeout.
+func (m *mapOperator[T]) operateMailFile(ctx context.Context, mf *mailfile.MailFile, r io.Reader) error {
+	v, err := m.mapFn(mf, r)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case m.results <- v:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mailFileOperator is an Operator passed the MailFile of each message,
+// used by call in place of Operate.
+type mailFileOperator interface {
+	Operator
+	operateMailFile(ctx context.Context, mf *mailfile.MailFile, r io.Reader) error
+}
@@ -0,0 +1,88 @@
+package mailboxoperator
+
+import (
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// fromAddress maps a message to its first From address.
+func fromAddress(mf *mailfile.MailFile, r io.Reader) (string, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return "", err
+	}
+	froms, err := msg.Header.AddressList("From")
+	if err != nil {
+		return "", err
+	}
+	return froms[0].Address, nil
+}
+
+func TestMapReduce(t *testing.T) {
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	for _, streaming := range []bool{false, true} {
+		var opts []Option
+		if streaming {
+			opts = append(opts, WithStreaming())
+		}
+		c := NewErrorCollector()
+		got, err := MapReduce(mboxes, maildirs, fromAddress,
+			func(acc map[string]int, from string) map[string]int {
+				acc[from]++
+				return acc
+			}, map[string]int{}, c.Handle, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, n := range got {
+			total += n
+		}
+		// the koi8-r encoded From of maildir offset 3 cannot be parsed
+		if total != 8 || len(c.Errors()) != 1 {
+			t.Errorf("streaming %t: got %d addresses %v and errors %v", streaming, total, got, c.Errors())
+		}
+	}
+
+	// the MailFile of each message is mapped
+	kinds, err := MapReduce(mboxes, maildirs,
+		func(mf *mailfile.MailFile, r io.Reader) (string, error) {
+			return mf.Kind, nil
+		},
+		func(acc map[string]int, kind string) map[string]int {
+			acc[kind]++
+			return acc
+		}, map[string]int{}, oeh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]int{"mbox": 3, "maildir": 6}, kinds); diff != "" {
+		t.Errorf("kinds diff %s", diff)
+	}
+
+	// stopping with an error returns the result so far
+	n, err := MapReduce(mboxes, maildirs, fromAddress,
+		func(acc int, _ string) int { return acc + 1 }, 0, oeh)
+	if err == nil || !strings.Contains(err.Error(), "charset") || n > 8 {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	// ErrStop
+	n, err = MapReduce(nil, maildirs,
+		func(*mailfile.MailFile, io.Reader) (int, error) { return 0, ErrStop },
+		func(acc int, _ int) int { return acc + 1 }, 0, oeh)
+	if err != nil || n != 0 {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	if _, err := MapReduce(nil, nil, fromAddress, func(acc int, _ string) int { return acc }, 0, oeh); err == nil {
+		t.Error("expected error for no mailboxes")
+	}
+}
@@ -0,0 +1,182 @@
+package mbox
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+	mbox "github.com/rorycl/mailboxoperator/mbox/parser"
+	"github.com/rorycl/mailboxoperator/uncompress"
+)
+
+// ErrIndexStale reports an Index which does not match its mbox file.
+var ErrIndexStale error = errors.New("index does not match mbox")
+
+// Index records the offset of each message in an mbox, with an
+// uncompress.Index of compressed mboxes, allowing messages to be
+// fetched without reading the mbox from the start.
+type Index struct {
+	Path    string
+	offsets []int64
+	index   *uncompress.Index
+}
+
+// WithIndexSpan sets the spacing, in uncompressed bytes, of the
+// checkpoints from which gzip decompression can resume when fetching
+// messages from an Index. Closer checkpoints make fetching faster at
+// the cost of a larger index, as each checkpoint holds 32KiB.
+func WithIndexSpan(n int64) Option {
+	return func(m *Mbox) {
+		m.indexSpan = n
+	}
+}
+
+// BuildIndex reads the mbox at path to build an Index of its messages.
+// The options set the detection of message boundaries and the gzip
+// index span.
+func BuildIndex(path string, opts ...Option) (*Index, error) {
+	m := Mbox{}
+	for _, o := range opts {
+		o(&m)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	ir, err := uncompress.NewIndexReader(f, m.indexSpan)
+	if err != nil && errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s is an empty mailbox: %w", path, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("uncompress error: %w", err)
+	}
+	defer func() {
+		_ = ir.Close()
+	}()
+
+	x := &Index{Path: path}
+	reader := mbox.NewMboxIOReader(ir, append(m.parserOpts, mbox.WithStreaming())...)
+	for {
+		r, err := reader.NextMessage()
+		if r == nil && err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		x.offsets = append(x.offsets, reader.Offset())
+	}
+	x.index, err = ir.Index()
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// CountMessages scans the mbox at path to count its messages, without
+// buffering them. The options set the detection of message boundaries
+// and decompression, as for NewMbox.
+func CountMessages(path string, opts ...Option) (int, error) {
+	m, err := NewMbox(path, append(opts, WithStreaming())...)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = m.Close()
+	}()
+	n := 0
+	for {
+		r, err := m.reader.NextMessage()
+		if r == nil && err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Len returns the number of messages in the mbox.
+func (x *Index) Len() int {
+	return len(x.offsets)
+}
+
+// Fetch returns message n of the mbox, numbered from zero as by
+// Mbox.NextReader. The returned io.ReadCloser should be closed after
+// reading.
+func (x *Index) Fetch(n int) (*mailfile.MailFile, io.ReadCloser, error) {
+	if n < 0 || n >= len(x.offsets) {
+		return nil, nil, fmt.Errorf("message %d out of range", n)
+	}
+	f, err := os.Open(x.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() != x.index.FileSize() {
+		err = fmt.Errorf("%w: %s", ErrIndexStale, x.Path)
+	}
+	var r io.Reader
+	if err == nil {
+		r, err = x.index.Reader(f, x.offsets[n])
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	end := x.index.Size()
+	if n+1 < len(x.offsets) {
+		end = x.offsets[n+1]
+	}
+	thisMail := mailfile.MailFile{
+		Kind: "mbox",
+		Path: x.Path,
+		No:   n,
+	}
+	return &thisMail, struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, end-x.offsets[n]), f}, nil
+}
+
+// indexFile is the encoding of an Index.
+type indexFile struct {
+	Path    string
+	Offsets []int64
+	Index   []byte
+}
+
+// MarshalBinary encodes the Index.
+func (x *Index) MarshalBinary() ([]byte, error) {
+	index, err := x.index.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	err = gob.NewEncoder(&b).Encode(indexFile{x.Path, x.offsets, index})
+	return b.Bytes(), err
+}
+
+// UnmarshalBinary decodes an Index encoded by MarshalBinary.
+func (x *Index) UnmarshalBinary(data []byte) error {
+	var i indexFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&i); err != nil {
+		return err
+	}
+	index := &uncompress.Index{}
+	if err := index.UnmarshalBinary(i.Index); err != nil {
+		return err
+	}
+	*x = Index{Path: i.Path, offsets: i.Offsets, index: index}
+	return nil
+}
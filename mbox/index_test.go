@@ -0,0 +1,146 @@
+package mbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	// gonuts.mbox.gz is written with a deflate block every 1000 bytes
+	gonuts, err := os.ReadFile("testdata/gonuts.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := filepath.Join(t.TempDir(), "gonuts.mbox.gz")
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	for chunk := range slices.Chunk(gonuts, 1000) {
+		if _, err := gw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gz, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mboxes := []string{
+		"testdata/golang.mbox",
+		"testdata/golang.mbox.bz2",
+		"testdata/gonuts.mbox",
+		"../uncompress/testdata/golang.blocks.mbox.xz",
+		gz,
+	}
+	for _, mailbox := range mboxes {
+		// the messages as read sequentially
+		var messages [][]byte
+		m, err := NewMbox(mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, r, err := m.NextReader()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, b)
+		}
+
+		x, err := BuildIndex(mailbox, WithIndexSpan(2048))
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := x.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		x = &Index{}
+		if err := x.UnmarshalBinary(enc); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := x.Len(), len(messages); got != want {
+			t.Fatalf("%s len got %d want %d", mailbox, got, want)
+		}
+
+		// fetch in reverse order
+		for n := x.Len() - 1; n >= 0; n-- {
+			mf, r, err := x.Fetch(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = r.Close()
+			if got, want := mf.No, n; got != want {
+				t.Errorf("%s No got %d want %d", mailbox, got, want)
+			}
+			if !bytes.Equal(b, messages[n]) {
+				t.Errorf("%s message %d differs", mailbox, n)
+			}
+		}
+		if _, _, err := x.Fetch(x.Len()); err == nil {
+			t.Errorf("%s expected out of range error", mailbox)
+		}
+	}
+}
+
+func TestIndexStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "golang.mbox")
+	contents, err := os.ReadFile("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	x, err := BuildIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, contents[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := x.Fetch(0); !errors.Is(err, ErrIndexStale) {
+		t.Errorf("expected ErrIndexStale, got %v", err)
+	}
+}
+
+func TestCountMessages(t *testing.T) {
+	tests := map[string]int{
+		"testdata/golang.mbox":     2,
+		"testdata/golang.mbox.bz2": 2,
+		"testdata/gonuts.mbox":     1,
+	}
+	for path, want := range tests {
+		got, err := CountMessages(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s got %d want %d messages", path, got, want)
+		}
+	}
+	if _, err := CountMessages("testdata/empty"); !errors.Is(err, io.EOF) {
+		t.Errorf("expected empty mailbox error, got %v", err)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/rorycl/mailboxoperator/mailfile"
 	mbox "github.com/rorycl/mailboxoperator/mbox/parser"
@@ -14,16 +17,90 @@ import (
 // Mbox represents an mbox file on disk with related go-mbox reader and
 // email position in the mbox file.
 type Mbox struct {
-	Path    string
-	current int // current message being read
-	file    *os.File
-	reader  *mbox.MboxIOReader
-	atEOF   bool
+	Path           string
+	current        int // current message being read
+	file           *os.File
+	reader         *mbox.MboxIOReader
+	uncompressed   io.Reader
+	atEOF          bool
+	parserOpts     []mbox.Option
+	uncompressOpts []uncompress.Option
+	indexSpan      int64
+	logger         *slog.Logger
+	err            error // the error stopping Messages, if any
+	closed         bool
+}
+
+// Option configures an Mbox.
+type Option func(*Mbox)
+
+// WithDetector sets the parser.BoundaryDetector used to find the
+// boundaries between messages in the mbox.
+func WithDetector(d mbox.BoundaryDetector) Option {
+	return func(m *Mbox) {
+		m.parserOpts = append(m.parserOpts, mbox.WithDetector(d))
+	}
+}
+
+// WithHeadersOnly sets the Mbox to provide only the header block of
+// each message, without buffering message bodies.
+func WithHeadersOnly() Option {
+	return func(m *Mbox) {
+		m.parserOpts = append(m.parserOpts, mbox.WithHeadersOnly())
+	}
+}
+
+// WithStreaming sets the Mbox to provide readers drawing directly on
+// the mbox file rather than buffering each message. Each reader is only
+// valid until the next call to NextReader.
+func WithStreaming() Option {
+	return func(m *Mbox) {
+		m.parserOpts = append(m.parserOpts, mbox.WithStreaming())
+	}
+}
+
+// WithBufferReuse sets the Mbox to reuse the buffer of each message for
+// later messages, reducing allocation. Each reader provided by
+// NextReader is then only valid until the next call to NextReader.
+func WithBufferReuse() Option {
+	return func(m *Mbox) {
+		m.parserOpts = append(m.parserOpts, mbox.WithBufferReuse())
+	}
+}
+
+// WithMaxMessageSize limits messages to n bytes. Reads beyond the
+// limit return mailfile.ErrMessageTooLarge, and the remainder of the
+// message is not buffered.
+func WithMaxMessageSize(n int64) Option {
+	return func(m *Mbox) {
+		m.parserOpts = append(m.parserOpts, mbox.WithMaxMessageSize(n))
+	}
+}
+
+// WithUncompressOptions sets options for the decompression of
+// compressed mboxes, such as limits protecting against decompression
+// bombs.
+func WithUncompressOptions(opts ...uncompress.Option) Option {
+	return func(m *Mbox) {
+		m.uncompressOpts = append(m.uncompressOpts, opts...)
+	}
+}
+
+// WithLogger sets the logger recording, at debug level, the opening
+// and closing of the mbox, the compression detected and the message
+// boundaries found by the parser. By default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(m *Mbox) {
+		m.logger = l
+	}
 }
 
 // NewMbox sets up a new mbox for reading
-func NewMbox(path string) (*Mbox, error) {
+func NewMbox(path string, opts ...Option) (*Mbox, error) {
 	m := Mbox{}
+	for _, o := range opts {
+		o(&m)
+	}
 	var err error
 	m.file, err = os.Open(path)
 	if err != nil {
@@ -31,9 +108,17 @@ func NewMbox(path string) (*Mbox, error) {
 	}
 	m.Path = path
 	m.current = -1
+	if m.logger == nil {
+		m.logger = slog.New(slog.DiscardHandler)
+	}
+	m.logger = m.logger.With("kind", "mbox", "path", path)
+	m.logger.Debug("mbox opened")
 
 	// transparent decompression of bzip2, xz and gzip files
-	u, err := uncompress.NewReader(m.file)
+	u, err := uncompress.NewReader(m.file, append(m.uncompressOpts, uncompress.WithLogger(m.logger))...)
+	if err != nil {
+		_ = m.file.Close()
+	}
 	if err != nil && errors.Is(err, io.EOF) {
 		return &m, fmt.Errorf("%s is an empty mailbox: %w", path, err)
 	}
@@ -41,12 +126,20 @@ func NewMbox(path string) (*Mbox, error) {
 		return &m, fmt.Errorf("uncompress error: %w", err)
 	}
 
-	m.reader = mbox.NewMboxIOReader(u)
+	m.uncompressed = u
+	m.reader = mbox.NewMboxIOReader(u, append(m.parserOpts, mbox.WithLogger(m.logger))...)
 	return &m, err
 }
 
 // NextReader returns the next Mail from the reader until exhausted. An
 // io.EOF encountered is deferred until the the next call to NextReader.
+//
+// An error reading the mbox, such as from a damaged compressed mbox, is
+// returned as a *mailfile.ReadError, together with the part of the
+// message read before the error, after which the mbox is exhausted. In
+// streaming mode the error is returned after the partial message has
+// been provided, with the MailFile of the partial message and a nil
+// reader.
 func (m *Mbox) NextReader() (*mailfile.MailFile, io.Reader, error) {
 	if m.atEOF {
 		return nil, nil, io.EOF
@@ -58,10 +151,106 @@ func (m *Mbox) NextReader() (*mailfile.MailFile, io.Reader, error) {
 		No:   m.current,
 	}
 	reader, err := m.reader.NextMessage()
-	if err != nil && err == io.EOF {
+	if err != nil {
 		m.atEOF = true
-		_ = m.file.Close()
+		_ = m.Close()
+	}
+	if err == io.EOF {
+		if reader == nil {
+			// streaming readers report io.EOF once exhausted
+			return nil, nil, io.EOF
+		}
 		return &thisMail, reader, nil
 	}
+	if err != nil {
+		if reader == nil {
+			thisMail.No--
+		}
+		err = &mailfile.ReadError{
+			Offset:   m.reader.Offset(),
+			Position: m.reader.Position(),
+			Err:      err,
+		}
+	}
 	return &thisMail, reader, err
 }
+
+// Messages returns an iterator over the messages of the mbox from the
+// next to be read by NextReader, avoiding its deferred io.EOF. Each
+// reader is only valid until the iteration continues, or in streaming
+// mode until the next message is read. Iteration stops at the first
+// error, such as a *mailfile.ReadError, which is reported by Err. The
+// mbox is closed once iteration ends, including when the loop is left
+// early.
+//
+//	for mf, r := range mb.Messages() {
+//		// do something with the io.Reader in r
+//	}
+//	if err := mb.Err(); err != nil {
+//		...
+//	}
+func (m *Mbox) Messages() iter.Seq2[*mailfile.MailFile, io.Reader] {
+	return func(yield func(*mailfile.MailFile, io.Reader) bool) {
+		for {
+			mf, r, err := m.NextReader()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				m.err = err
+				return
+			}
+			more := yield(mf, r)
+			if c, ok := r.(io.Closer); ok {
+				_ = c.Close()
+			}
+			if !more {
+				_ = m.Close()
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error which stopped the iterator returned by
+// Messages, if any.
+func (m *Mbox) Err() error {
+	return m.err
+}
+
+// Close closes the decompressing reader, stopping any parallel
+// decompression, and the file. The mbox is closed once NextReader
+// reaches its end or an error, so Close need only be called if it is
+// not read to the end. NextReader returns io.EOF once the mbox is
+// closed. Close may be called more than once.
+func (m *Mbox) Close() error {
+	if m.closed || m.reader == nil {
+		return nil
+	}
+	m.closed, m.atEOF = true, true
+	if c, ok := m.uncompressed.(io.Closer); ok {
+		_ = c.Close()
+	}
+	err := m.file.Close()
+	m.logger.Debug("mbox closed", "position", m.reader.Position())
+	return err
+}
+
+// BytesRead returns the bytes read from the mbox file and, for
+// compressed mboxes, the uncompressed bytes read. Messages are read
+// ahead, so these may exceed the bytes of the messages provided.
+func (m *Mbox) BytesRead() (file, uncompressed int64) {
+	if c, ok := m.uncompressed.(uncompress.Counter); ok {
+		return c.BytesRead()
+	}
+	return 0, 0
+}
+
+// ReadTime returns the time spent reading and decompressing the mbox
+// file, excluding the time spent parsing it.
+func (m *Mbox) ReadTime() time.Duration {
+	if t, ok := m.uncompressed.(uncompress.Timer); ok {
+		return t.ReadTime()
+	}
+	return 0
+}
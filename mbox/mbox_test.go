@@ -2,12 +2,18 @@ package mbox
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+	"github.com/rorycl/mailboxoperator/uncompress"
 )
 
 func TestMbox(t *testing.T) {
@@ -58,6 +64,18 @@ Received: from mail-oo1-f59.google.com ([209.85.161.59])`, mailbox)
 		if got, want := strings.TrimSpace(firstFiveLines), strings.TrimSpace(lastFileHeader); got != want {
 			t.Errorf("last file header error\ngot\n%s\nwant\n%s", got, want)
 		}
+
+		fi, err := os.Stat(mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, uncompressed := md.BytesRead()
+		if file != fi.Size() || uncompressed < file {
+			t.Errorf("bytes read got %d, %d for file of %d bytes", file, uncompressed, fi.Size())
+		}
+		if md.ReadTime() <= 0 {
+			t.Errorf("read time got %s", md.ReadTime())
+		}
 	}
 }
 
@@ -74,3 +92,174 @@ func TestInvalidMbox(t *testing.T) {
 	}
 	fmt.Println(err)
 }
+
+func TestMboxStreaming(t *testing.T) {
+	mboxes := []string{"testdata/golang.mbox", "testdata/golang.mbox.bz2"}
+
+	for _, mailbox := range mboxes {
+		md, err := NewMbox(mailbox, WithStreaming())
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter := 0
+		for {
+			m, r, err := md.NextReader()
+			if err != nil && err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := m.No, counter; got != want {
+				t.Errorf("mail number got %d want %d", got, want)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(b), "From ") {
+				t.Errorf("mail %d does not start with a postmark", counter)
+			}
+			counter++
+		}
+		if got, want := counter, 2; got != want {
+			t.Errorf("counter got %d want %d", got, want)
+		}
+	}
+}
+
+func TestMboxMessages(t *testing.T) {
+	mboxes := []string{"testdata/golang.mbox", "testdata/golang.mbox.bz2"}
+
+	for _, mailbox := range mboxes {
+		for _, opts := range [][]Option{nil, {WithStreaming()}} {
+			md, err := NewMbox(mailbox, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nos := []int{}
+			for m, r := range md.Messages() {
+				b, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(string(b), "From ") {
+					t.Errorf("%s mail %d does not start with a postmark", mailbox, m.No)
+				}
+				nos = append(nos, m.No)
+			}
+			if err := md.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(nos), 2; got != want {
+				t.Errorf("%s got %d want %d mails", mailbox, got, want)
+			}
+		}
+	}
+
+	// breaking closes the mbox
+	for _, opts := range [][]Option{nil, {WithUncompressOptions(uncompress.WithParallel(2))}} {
+		md, err := NewMbox("testdata/golang.mbox.bz2", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range md.Messages() {
+			break
+		}
+		if _, err := md.file.Stat(); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected closed file, got %v", err)
+		}
+		if _, _, err := md.NextReader(); err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+	}
+}
+
+func TestMboxMessagesDamaged(t *testing.T) {
+	b, err := os.ReadFile("testdata/golang.mbox.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := filepath.Join(t.TempDir(), "golang.mbox.bz2")
+	if err := os.WriteFile(damaged, b[:len(b)*9/10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	md, err := NewMbox(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range md.Messages() {
+	}
+	var re *mailfile.ReadError
+	if !errors.As(md.Err(), &re) {
+		t.Errorf("expected ReadError, got %v", md.Err())
+	}
+}
+
+func TestMboxReadersRetained(t *testing.T) {
+	// read each message before reading the next
+	want := [][]byte{}
+	md, err := NewMbox("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range md.Messages() {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, b)
+	}
+
+	// without buffer reuse each reader remains valid after the next
+	// call to NextReader
+	md, err = NewMbox("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers := []io.Reader{}
+	for {
+		_, r, err := md.NextReader()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, r)
+	}
+	if len(readers) != len(want) {
+		t.Fatalf("got %d want %d readers", len(readers), len(want))
+	}
+	for i, r := range readers {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want[i]) {
+			t.Errorf("message %d of %d bytes changed to %d bytes", i, len(want[i]), len(b))
+		}
+	}
+}
+
+func TestMboxClose(t *testing.T) {
+	mb, err := NewMbox("testdata/golang.mbox.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mb.NextReader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mb.file.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected closed file, got %v", err)
+	}
+	if _, _, err := mb.NextReader(); err != io.EOF {
+		t.Errorf("expected io.EOF after Close, got %v", err)
+	}
+	if err := mb.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// BoundaryDetector determines where one message ends and the next
+// begins in an mbox. A boundary is found in two steps: a line is first
+// considered as a candidate postmark line given the line preceding it,
+// and the candidate is then confirmed (or rejected) by the line that
+// follows it.
+//
+// Callers may supply their own BoundaryDetector to deal with unusual
+// mailboxes. Implementations must be safe for concurrent use if shared
+// between readers.
+type BoundaryDetector interface {
+	// Postmark reports if line is a candidate postmark line. previous
+	// is the preceding line, which is empty at the start of the
+	// mailbox.
+	Postmark(previous, line []byte) bool
+	// Confirm reports if the line following a candidate postmark line
+	// confirms the start of a new message.
+	Confirm(line []byte) bool
+}
+
+var (
+	// StrictDetector follows RFC 4155: a postmark line of "From ", an
+	// addr-spec without whitespace and an asctime(3) timestamp,
+	// preceded by an empty line and followed by a header line.
+	StrictDetector BoundaryDetector = &regexpDetector{
+		name:       "strict",
+		postmark:   strictPostMarkRegexp,
+		confirm:    strictHeaderLineRegexp,
+		checksNull: true,
+	}
+
+	// LenientDetector is the package default. It accepts the loose
+	// postmark described by postMarkRegexp (which requires an "@" in the
+	// sender) followed by a header line or a ">From" line. The
+	// preceding line is not checked, as some archives omit the empty
+	// line before a postmark.
+	LenientDetector BoundaryDetector = &regexpDetector{
+		name:     "lenient",
+		postmark: postMarkRegexp,
+		confirm:  emailHeaderLineRegexp,
+	}
+
+	// GrepmailDetector uses the Mail::Mbox::MessageParser "From_"
+	// pattern used by grepmail, which does not require an "@" in the
+	// sender, followed by a header line or a ">From" line. This suits
+	// mailboxes written by mailing list software recording bare list
+	// names as the envelope sender.
+	GrepmailDetector BoundaryDetector = &regexpDetector{
+		name:       "grepmail",
+		postmark:   grepmailPostMarkRegexp,
+		confirm:    emailHeaderLineRegexp,
+		checksNull: true,
+	}
+)
+
+// strictPostMarkRegexp is an RFC 4155 postmark line:
+//
+//	From jane@example.com Wed Oct  5 01:06:54 2000
+//
+// being "From ", a sender without whitespace, a single space and an
+// asctime(3) date-time, optionally followed by a timezone.
+var strictPostMarkRegexp *regexp.Regexp = regexp.MustCompile(
+	`^From [^\s]+ (Mon|Tue|Wed|Thu|Fri|Sat|Sun) (Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) [ 0-9]\d \d\d:\d\d:\d\d( [A-Z]{2,6}| [+-]\d{4})* \d{4}\s*$`,
+)
+
+// strictHeaderLineRegexp matches an RFC 5322 header field line.
+var strictHeaderLineRegexp *regexp.Regexp = regexp.MustCompile(
+	`^[!-9;-~]+:`,
+)
+
+// grepmailPostMarkRegexp is the Mail::Mbox::MessageParser
+// 'from_pattern' (shown at postMarkRegexp) translated to go regexp
+// syntax, which lacks atomic groups.
+var grepmailPostMarkRegexp *regexp.Regexp = regexp.MustCompile(
+	`^From\s[^:\n]+(:\d\d){1,2}(\s+([A-Z]{2,6}|[+-]?\d{4})){1,3}(\sremote\sfrom\s.*)?`,
+)
+
+// regexpDetector is a BoundaryDetector using a pair of regular
+// expressions.
+type regexpDetector struct {
+	name       string
+	postmark   *regexp.Regexp
+	confirm    *regexp.Regexp
+	checksNull bool // the previous line must be null
+}
+
+// Postmark reports if line matches the postmark regexp and, if
+// required, follows a null line.
+func (d *regexpDetector) Postmark(previous, line []byte) bool {
+	if !bytes.HasPrefix(line, []byte("From")) {
+		return false
+	}
+	if d.checksNull && !lineIsNull(previous) {
+		return false
+	}
+	return d.postmark.Match(line)
+}
+
+// Confirm reports if line matches the confirmation regexp.
+func (d *regexpDetector) Confirm(line []byte) bool {
+	return d.confirm.Match(line)
+}
+
+// String returns the detector name.
+func (d *regexpDetector) String() string {
+	return d.name
+}
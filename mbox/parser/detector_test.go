@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDetectorPostmark(t *testing.T) {
+	tests := []struct {
+		previous string
+		line     string
+		strict   bool
+		lenient  bool
+		grepmail bool
+	}{
+		{
+			previous: "",
+			line:     "From jane@example.com Wed Oct  5 01:06:54 2000\n",
+			strict:   true,
+			lenient:  true,
+			grepmail: true,
+		},
+		{
+			previous: "some text\n",
+			line:     "From jane@example.com Wed Oct  5 01:06:54 2000\n",
+			strict:   false,
+			lenient:  true,
+			grepmail: false,
+		},
+		{
+			previous: "\r\n",
+			line:     "From golang-announce Mon Mar  3 10:00:00 2025\r\n",
+			strict:   true,
+			lenient:  false,
+			grepmail: true,
+		},
+		{
+			previous: "",
+			line:     "From david@coppit.org Sat Sep  1 20:58 EDT 2001\n",
+			strict:   false,
+			lenient:  true,
+			grepmail: true,
+		},
+		{
+			previous: "",
+			line:     "From all of us\n",
+			strict:   false,
+			lenient:  false,
+			grepmail: false,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			p, l := []byte(tt.previous), []byte(tt.line)
+			if got, want := StrictDetector.Postmark(p, l), tt.strict; got != want {
+				t.Errorf("strict got %t want %t", got, want)
+			}
+			if got, want := LenientDetector.Postmark(p, l), tt.lenient; got != want {
+				t.Errorf("lenient got %t want %t", got, want)
+			}
+			if got, want := GrepmailDetector.Postmark(p, l), tt.grepmail; got != want {
+				t.Errorf("grepmail got %t want %t", got, want)
+			}
+		})
+	}
+}
+
+// everyLine is a detector which considers every "From " line a
+// boundary.
+type everyLine struct{}
+
+func (e everyLine) Postmark(previous, line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+func (e everyLine) Confirm(line []byte) bool {
+	return true
+}
+
+func TestDetectorMailbox(t *testing.T) {
+	tests := []struct {
+		detector BoundaryDetector
+		no       int
+	}{
+		{LenientDetector, 1},
+		{StrictDetector, 3},
+		{GrepmailDetector, 3},
+		{everyLine{}, 3},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			f, err := os.Open("../testdata/list.mbox")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			mr := NewMboxIOReader(f, WithDetector(tt.detector))
+			if got, want := drain(mr, t), tt.no; got != want {
+				t.Errorf("got %d want %d emails", got, want)
+			}
+		})
+	}
+}
@@ -24,9 +24,14 @@
 //
 // To differentiate between lines that look like "From_" separator lines
 // and similarly structured content in emails, the program ensures that
-// each  postmark line is either preceeded by no lines or an empty line,
-// and is followed by either an email header line or (as a special case)
-// a ">From" header added from broken older mailing list software.
+// each postmark line is followed by either an email header line or (as
+// a special case) a ">From" header added from broken older mailing list
+// software.
+//
+// The rules used to find message boundaries are provided by a
+// BoundaryDetector. StrictDetector (RFC 4155), LenientDetector (the
+// default) and GrepmailDetector are built in, and callers may supply
+// their own with WithDetector.
 //
 // The parser works with both dos and unix line endings.
 //
@@ -37,9 +42,14 @@ package parser
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"regexp"
+	"sync"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
 )
 
 // postMarkRegexp marks the absolute essentials of a "postmark" line
@@ -85,6 +95,125 @@ var emailHeaderLineRegexp *regexp.Regexp = regexp.MustCompile(
 	`^([A-Za-z-]+: [^ ]+|>From.*:.*[0-9]{2,4})`,
 )
 
+// Option configures an MboxFileReader or MboxIOReader.
+type Option func(*config)
+
+// config holds the options shared by the mbox readers.
+type config struct {
+	detector    BoundaryDetector
+	headersOnly bool
+	streaming   bool
+	maxSize     int64
+	reuse       bool
+	logger      *slog.Logger
+}
+
+// newConfig returns a config with defaults overridden by opts.
+func newConfig(opts []Option) config {
+	c := config{
+		detector: LenientDetector,
+		logger:   slog.New(slog.DiscardHandler),
+	}
+	for _, o := range opts {
+		o(&c)
+	}
+	return c
+}
+
+// WithDetector sets the BoundaryDetector used to find the boundaries
+// between messages. The default is LenientDetector.
+func WithDetector(d BoundaryDetector) Option {
+	return func(c *config) {
+		if d != nil {
+			c.detector = d
+		}
+	}
+}
+
+// WithHeadersOnly sets MboxIOReader to provide only the header block of
+// each message, up to and including the first empty line. Body lines
+// are still scanned for message boundaries but are not buffered. The
+// option has no effect on MboxFileReader.
+func WithHeadersOnly() Option {
+	return func(c *config) {
+		c.headersOnly = true
+	}
+}
+
+// WithStreaming sets MboxIOReader to provide each message as a reader
+// drawing directly on the underlying io.Reader rather than buffering
+// the message. See MboxIOReader.NextMessage for the effect on the end
+// of mbox semantics. The option has no effect on MboxFileReader.
+func WithStreaming() Option {
+	return func(c *config) {
+		c.streaming = true
+	}
+}
+
+// WithMaxMessageSize limits MboxIOReader messages to n bytes. Messages
+// are truncated at the limit, without buffering the remainder, and
+// reads beyond the limit return mailfile.ErrMessageTooLarge. The
+// option has no effect on MboxFileReader.
+func WithMaxMessageSize(n int64) Option {
+	return func(c *config) {
+		c.maxSize = n
+	}
+}
+
+// WithBufferReuse sets MboxIOReader to return the buffer of each
+// message to a pool for reuse by later messages, so that the io.Reader
+// provided by NextMessage is only valid until the next call to
+// NextMessage. By default each message has its own buffer. The option
+// has no effect on MboxFileReader.
+func WithBufferReuse() Option {
+	return func(c *config) {
+		c.reuse = true
+	}
+}
+
+// WithLogger sets the logger recording, at debug level, the message
+// boundaries found and the candidate postmark lines rejected, with
+// their line numbers. By default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *config) {
+		if l != nil {
+			c.logger = l
+		}
+	}
+}
+
+// logDetector logs the BoundaryDetector in use.
+func (c *config) logDetector() {
+	name := fmt.Sprintf("%T", c.detector)
+	if s, ok := c.detector.(fmt.Stringer); ok {
+		name = s.String()
+	}
+	c.logger.Debug("boundary detector", "detector", name)
+}
+
+// logPostmark logs a line starting "From " at line number n which the
+// detector did not consider a candidate postmark line.
+func (c *config) logPostmark(n int64, line []byte) {
+	if bytes.HasPrefix(line, []byte("From ")) {
+		c.logger.Debug("postmark not matched", "line", n, "text", logText(line))
+	}
+}
+
+// logRejected logs the candidate postmark line at line number n which
+// was rejected by the following line.
+func (c *config) logRejected(n int64, candidate, line []byte) {
+	c.logger.Debug("candidate postmark rejected", "line", n, "text", logText(candidate), "next", logText(line))
+}
+
+// logText returns line trimmed to a length suitable for logging.
+func logText(line []byte) string {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > 120 {
+		line = line[:120]
+	}
+	return string(line)
+}
+
 // fileOffsets are pairs of start/end file byte position markers
 type fileOffsets struct {
 	start, end int64
@@ -94,6 +223,7 @@ type fileOffsets struct {
 // requires seeking and is an efficient way of reading bytes from a
 // large, uncompressed, mbox file.
 type MboxFileReader struct {
+	config
 	file             *os.File
 	scanner          *bufio.Scanner
 	start            int64 // start position in the file
@@ -104,18 +234,21 @@ type MboxFileReader struct {
 	atEOF            bool
 	msgStart, msgEnd int64 // start and end positions of last message in file
 	total            int
+	lineNo           int64 // number of the last line scanned
 }
 
 // NewMboxFileReader creates a new MboxFileReader.
-func NewMboxFileReader(file *os.File) *MboxFileReader {
+func NewMboxFileReader(file *os.File, opts ...Option) *MboxFileReader {
 	scanner := bufio.NewScanner(file)
 	scanner.Split(lineSplitter)
 	mr := &MboxFileReader{
+		config:   newConfig(opts),
 		file:     file,
 		scanner:  scanner,
 		lastLine: []byte{},
 		offsets:  []fileOffsets{},
 	}
+	mr.logDetector()
 	return mr
 }
 
@@ -151,6 +284,7 @@ func (mr *MboxFileReader) scan() bool {
 		by := mr.scanner.Bytes()
 		previousCounter := mr.counter
 		mr.counter += int64(len(by))
+		mr.lineNo++
 
 		// If an offsets entry has been made for the previous line,
 		// ensure that this line is an email header line (key: value) or
@@ -158,24 +292,28 @@ func (mr *MboxFileReader) scan() bool {
 		// last insert into allOffsets.
 		if mr.justInserted {
 			mr.justInserted = false
-			if !emailHeaderLineRegexp.Match(by) {
+			if !mr.detector.Confirm(by) {
 				mr.offsets = mr.offsets[:len(mr.offsets)-1]
+				mr.logRejected(mr.lineNo-1, mr.lastLine, by)
 			} else {
+				mr.logger.Debug("message boundary", "line", mr.lineNo-1, "offset", mr.start)
 				setFilePositions()
 				return true
 			}
 		}
 
-		// if the line starts with from and the last line is null and it
-		// meets the (rough) postmarkregex.
-		if postMarkRegexp.Match(by) && lineIsNull(mr.lastLine) {
+		// if the detector considers the line a candidate postmark
+		// line, given the last line.
+		if mr.detector.Postmark(mr.lastLine, by) {
 			if previousCounter > 0 {
 				mr.offsets = append(mr.offsets, fileOffsets{mr.start, previousCounter})
 				mr.justInserted = true
 			}
 			mr.start = previousCounter
+		} else {
+			mr.logPostmark(mr.lineNo, by)
 		}
-		copy(mr.lastLine, by)
+		mr.lastLine = append(mr.lastLine[:0], by...)
 	}
 	mr.offsets = append(mr.offsets, fileOffsets{mr.start, mr.counter})
 	setFilePositions()
@@ -186,102 +324,306 @@ func (mr *MboxFileReader) scan() bool {
 
 // MboxIOReader reads reads emails from an mbox io.reader. This mode of
 // reading supports reading from streams, but has to buffer the results
-// in order to provide complete emails.
+// in order to provide complete emails, unless streaming is set with
+// WithStreaming.
 type MboxIOReader struct {
-	reader       io.Reader
-	buf          *bytes.Buffer
-	tmp          *bytes.Buffer // temporary line buffer
-	scanner      *bufio.Scanner
-	lastLine     []byte
-	justInserted bool
-	atEOF        bool
-	total        int
+	config
+	reader          io.Reader
+	buf             *bytes.Buffer
+	scanner         *bufio.Scanner
+	lastLine        []byte
+	queue           [][]byte // lines to be provided before scanning further
+	candidate       []byte   // a candidate postmark line awaiting confirmation
+	boundary        bool     // the current message has ended at a postmark
+	lines           int      // lines provided for the current message
+	inBody          bool     // past the header block of the current message
+	stream          *messageStream
+	truncated       bool  // the current message exceeds maxSize
+	err             error // error from the underlying reader
+	atEOF           bool
+	total           int
+	scanned         int64 // bytes scanned from the underlying reader
+	offset          int64 // offset of the current message
+	next            int64 // offset of the next message, once confirmed
+	candidateOffset int64 // offset of the candidate postmark line
+	lineNo          int64 // number of the last line scanned
 }
 
 // NewMboxIOReader creates an MboxIOReader from an io.Reader.
-func NewMboxIOReader(r io.Reader) *MboxIOReader {
+func NewMboxIOReader(r io.Reader, opts ...Option) *MboxIOReader {
 	scanner := bufio.NewScanner(r)
 	scanner.Split(lineSplitter)
 	mr := &MboxIOReader{
+		config:   newConfig(opts),
 		reader:   r,
-		buf:      bytes.NewBuffer(nil),
-		tmp:      bytes.NewBuffer(nil),
 		scanner:  scanner,
 		lastLine: []byte{},
 	}
+	mr.logDetector()
 	return mr
 }
 
 // NextMessage progressively provides the next email (as an io.Reader)
 // in an mbox until io.EOF. Note that the io.Reader may have valid
-// contents if the error is io.EOF.
+// contents if the error is io.EOF, or holds the part of the email read
+// before an error from the underlying reader. With WithBufferReuse the
+// io.Reader is only valid until the next call to NextMessage.
+//
+// In streaming mode the io.Reader reads directly from the underlying
+// reader and is only valid until the next call to NextMessage, which
+// discards any unread part of the message. As the end of the mbox is
+// only known once the last message has been read, io.EOF is returned
+// with a nil io.Reader when no messages remain.
 func (mr *MboxIOReader) NextMessage() (io.Reader, error) {
+	if mr.streaming {
+		return mr.nextStream()
+	}
 	_ = mr.scan()
 	var err error
 	if mr.atEOF {
 		err = io.EOF
 	}
+	if mr.err != nil {
+		err = mr.err
+	}
 	mr.total++
+	if mr.truncated {
+		return mailfile.TruncatedReader(mr.buf), err
+	}
 	return mr.buf, err
 }
 
+// Offset returns the byte offset in the underlying reader of the start
+// of the message last provided by NextMessage.
+func (mr *MboxIOReader) Offset() int64 {
+	return mr.offset
+}
+
+// Position returns the number of bytes read from the underlying
+// reader, which following an error is the position of the error.
+func (mr *MboxIOReader) Position() int64 {
+	return mr.scanned
+}
+
 // scan scans an mbox mailbox to retrieve each email in the mailbox in
-// bytes. The scan function keeps track of the line preceeding a
-// postmark line and check the line after it is a valid header, to help
-// differentiate from postmark lines in the body of emails.
+// bytes, returning false at the end of the mailbox.
 func (mr *MboxIOReader) scan() bool {
+	if mr.reuse {
+		putBuffer(mr.buf)
+		mr.buf = getBuffer()
+	} else {
+		mr.buf = new(bytes.Buffer)
+	}
+	mr.startMessage()
+	for {
+		line, ok := mr.messageLine()
+		if !ok {
+			break
+		}
+		if mr.maxSize > 0 {
+			room := max(mr.maxSize-int64(mr.buf.Len()), 0)
+			if int64(len(line)) > room {
+				line = line[:room]
+				mr.truncated = true
+			}
+		}
+		_, _ = mr.buf.Write(line)
+	}
+	return !mr.atEOF
+}
+
+// nextStream provides the next email as a messageStream, first
+// discarding the unread part of any previous message.
+func (mr *MboxIOReader) nextStream() (io.Reader, error) {
+	if mr.stream != nil {
+		mr.stream.mr = nil
+		for {
+			if _, ok := mr.messageLine(); !ok {
+				break
+			}
+		}
+	}
+	mr.startMessage()
+	line, ok := mr.messageLine()
+	if !ok {
+		mr.stream = nil
+		if mr.err != nil {
+			return nil, mr.err
+		}
+		return nil, io.EOF
+	}
+	mr.total++
+	mr.stream = &messageStream{
+		mr:      mr,
+		pending: bytes.Clone(line),
+	}
+	if mr.maxSize > 0 {
+		return mailfile.LimitReader(mr.stream, mr.maxSize), nil
+	}
+	return mr.stream, nil
+}
 
-	mr.buf = bytes.NewBuffer(nil)
+// startMessage resets the per-message state.
+func (mr *MboxIOReader) startMessage() {
+	mr.offset = mr.next
+	mr.boundary = false
+	mr.lines = 0
+	mr.inBody = false
+	mr.truncated = false
+}
 
-	loadBufFromTmp := func() {
-		_, _ = mr.buf.Write(mr.tmp.Bytes())
-		mr.tmp = bytes.NewBuffer(nil)
+// messageLine provides the next line of the current message, or false
+// if the message has ended. In headers only mode, lines following the
+// first null line of the message are discarded.
+func (mr *MboxIOReader) messageLine() ([]byte, bool) {
+	for {
+		line, ok := mr.nextLine()
+		if !ok {
+			return nil, false
+		}
+		if !mr.headersOnly {
+			return line, true
+		}
+		if mr.inBody {
+			continue
+		}
+		if lineIsNull(line) {
+			mr.inBody = true
+		}
+		return line, true
 	}
+}
 
-	// If mr.tmp holds data, add the data to mr.buf and empty mr.tmp.
-	if mr.tmp.Len() > 0 {
-		loadBufFromTmp()
+// nextLine scans the mbox for the next line of the current message,
+// returning false when the message ends at a confirmed postmark line
+// or the end of the mbox. The scan keeps track of the line preceeding
+// a postmark line and checks the line after it is a valid header, to
+// help differentiate from postmark lines in the body of emails.
+//
+// The returned line is only valid until the next call to nextLine.
+func (mr *MboxIOReader) nextLine() ([]byte, bool) {
+	if mr.boundary {
+		return nil, false
+	}
+	if len(mr.queue) > 0 {
+		line := mr.queue[0]
+		mr.queue = mr.queue[1:]
+		return mr.provide(line), true
 	}
 
 	for mr.scanner.Scan() {
 		by := mr.scanner.Bytes()
+		lineOffset := mr.scanned
+		mr.scanned += int64(len(by))
+		mr.lineNo++
 
-		// If an offsets entry has been made for the previous line,
-		// ensure that this line is an email header line (key: value) or
-		// a ">From" line (for older mbox formats), else do not start a
-		// new email.
-		if mr.justInserted {
-			mr.justInserted = false
-			_, _ = mr.tmp.Write(by)
-
-			// If the last line was not a valid postmark line, put the
-			// tmp buffer onto the main buf and continue
-			if !emailHeaderLineRegexp.Match(by) {
-				loadBufFromTmp()
-				continue
-			} else {
-				return true
+		// If a candidate postmark line was found on the previous line,
+		// ensure that this line is an email header line (key: value)
+		// or a ">From" line (for older mbox formats), else do not
+		// start a new email. A confirmed postmark line and this line
+		// are queued as the start of the next message.
+		if mr.candidate != nil {
+			candidate := mr.candidate
+			mr.candidate = nil
+			if mr.detector.Confirm(by) {
+				mr.logger.Debug("message boundary", "line", mr.lineNo-1, "offset", mr.candidateOffset)
+				mr.queue = append(mr.queue, candidate, bytes.Clone(by))
+				mr.boundary = true
+				mr.next = mr.candidateOffset
+				return nil, false
 			}
+			mr.logRejected(mr.lineNo-1, candidate, by)
+			mr.queue = append(mr.queue, bytes.Clone(by))
+			return mr.provide(candidate), true
 		}
 
-		// If the line starts with from and the last line is null and it
-		// meets the (rough) postmarkregex and there is already data
-		// written in mr.buf, start writing to the tmp line holder to
-		// check for a valid header line on the next loop.
-		if postMarkRegexp.Match(by) && lineIsNull(mr.lastLine) && mr.buf.Len() > 0 {
-			mr.justInserted = true
-			_, _ = mr.tmp.Write(by)
+		// If the detector considers the line a candidate postmark line,
+		// given the last line, and the message already has content,
+		// hold the line to check for a valid header line on the next
+		// loop.
+		if mr.lines > 0 && mr.detector.Postmark(mr.lastLine, by) {
+			mr.candidate = bytes.Clone(by)
+			mr.candidateOffset = lineOffset
 			continue
 		}
+		if mr.lines > 0 {
+			mr.logPostmark(mr.lineNo, by)
+		}
 
-		// add the line to the buffer
-		_, _ = mr.buf.Write(by)
-		copy(mr.lastLine, by)
+		return mr.provide(by), true
 	}
 
-	loadBufFromTmp()
 	mr.atEOF = true
-	return false
+	mr.err = mr.scanner.Err()
+	if mr.candidate != nil {
+		candidate := mr.candidate
+		mr.candidate = nil
+		return mr.provide(candidate), true
+	}
+	return nil, false
+}
+
+// provide records line as the last line provided for the current
+// message.
+func (mr *MboxIOReader) provide(line []byte) []byte {
+	mr.lastLine = append(mr.lastLine[:0], line...)
+	mr.lines++
+	return line
+}
+
+// messageStream is an io.Reader providing a message directly from the
+// MboxIOReader scanner.
+type messageStream struct {
+	mr      *MboxIOReader // nil once the stream is no longer valid
+	pending []byte        // unread part of the current line
+}
+
+// Read reads the next bytes of the message.
+func (s *messageStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.mr == nil {
+			return 0, io.EOF
+		}
+		line, ok := s.mr.messageLine()
+		if !ok {
+			err := s.mr.err
+			s.mr = nil
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		s.pending = line
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// maxPooledBuffer is the largest buffer capacity returned to
+// bufferPool, to avoid retaining the memory of unusually large
+// messages.
+const maxPooledBuffer = 16 << 20
+
+// bufferPool holds message buffers for reuse by MboxIOReaders.
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from bufferPool.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer resets b and returns it to bufferPool.
+func putBuffer(b *bytes.Buffer) {
+	if b == nil || b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
 }
 
 // lineSplitter is a bufio.Split function which is like bufio.SplitLines
@@ -2,10 +2,17 @@ package parser
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
 )
 
 type mboxReader interface {
@@ -203,3 +210,243 @@ func sliceFile(f *os.File, s, e int64, outPath string) error {
 	return nil
 }
 */
+
+func TestIOParserHeadersOnly(t *testing.T) {
+	f, err := os.Open("testdata/mailarc-1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	mr := NewMboxIOReader(f, WithHeadersOnly())
+	counter := 0
+	for {
+		r, err := mr.NextMessage()
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		contents, rErr := io.ReadAll(r)
+		if rErr != nil {
+			t.Fatal(rErr)
+		}
+		if !bytes.HasPrefix(contents, []byte("From ")) {
+			t.Errorf("message %d does not start with a postmark", counter)
+		}
+		// only the final line of the header block may be empty
+		before, after, found := bytes.Cut(contents, []byte("\n\n"))
+		if !found || len(after) != 0 || len(before) == 0 {
+			t.Errorf("message %d is not a header block:\n%s", counter, contents)
+		}
+		counter++
+		if err == io.EOF {
+			break
+		}
+	}
+	if got, want := counter, 16; got != want {
+		t.Errorf("got %d want %d emails", got, want)
+	}
+}
+
+func TestIOParserStreaming(t *testing.T) {
+	tests := []struct {
+		file string
+		no   int
+	}{
+		{
+			file: "testdata/mailarc-1.txt",
+			no:   16,
+		},
+		{
+			file: "testdata/mailarc-2.txt",
+			no:   5,
+		},
+		{
+			file: "testdata/mailarc-3.txt",
+			no:   17,
+		},
+		{
+			file: "testdata/mailarc-1-dos.txt", // dos
+			no:   16,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			contents, err := os.ReadFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// streamed messages concatenate to the original file
+			mr := NewMboxIOReader(bytes.NewReader(contents), WithStreaming())
+			var all bytes.Buffer
+			counter := 0
+			for {
+				r, err := mr.NextMessage()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := all.ReadFrom(r); err != nil {
+					t.Fatal(err)
+				}
+				counter++
+			}
+			if got, want := counter, tt.no; got != want {
+				t.Errorf("got %d want %d emails", got, want)
+			}
+			if !bytes.Equal(all.Bytes(), contents) {
+				t.Error("streamed messages do not match file contents")
+			}
+
+			// partially read messages are skipped
+			mr = NewMboxIOReader(bytes.NewReader(contents), WithStreaming())
+			counter = 0
+			for {
+				r, err := mr.NextMessage()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				line := make([]byte, 5)
+				if _, err := io.ReadFull(r, line); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := string(line), "From "; got != want {
+					t.Errorf("message %d got %q want %q", counter, got, want)
+				}
+				counter++
+			}
+			if got, want := counter, tt.no; got != want {
+				t.Errorf("partial read got %d want %d emails", got, want)
+			}
+		})
+	}
+}
+
+func TestIOParserMaxMessageSize(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streaming_%t", streaming), func(t *testing.T) {
+			f, err := os.Open("testdata/mailarc-2.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			opts := []Option{WithMaxMessageSize(100)}
+			if streaming {
+				opts = append(opts, WithStreaming())
+			}
+			mr := NewMboxIOReader(f, opts...)
+			counter := 0
+			for {
+				r, err := mr.NextMessage()
+				if r == nil && err == io.EOF {
+					break
+				}
+				if err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+				contents, rErr := io.ReadAll(r)
+				if !errors.Is(rErr, mailfile.ErrMessageTooLarge) {
+					t.Errorf("message %d expected too large error, got %v", counter, rErr)
+				}
+				if got, want := len(contents), 100; got != want {
+					t.Errorf("message %d got %d want %d bytes", counter, got, want)
+				}
+				counter++
+				if err == io.EOF {
+					break
+				}
+			}
+			if got, want := counter, 5; got != want {
+				t.Errorf("got %d want %d emails", got, want)
+			}
+		})
+	}
+}
+
+func TestIOParserOffset(t *testing.T) {
+	for _, file := range []string{"testdata/mailarc-1.txt", "testdata/mailarc-1-dos.txt", "testdata/mailarc-3.txt"} {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr := NewMboxIOReader(bytes.NewReader(contents))
+		for i := 0; ; i++ {
+			r, err := mr.NextMessage()
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(r)
+			off := mr.Offset()
+			if !bytes.Equal(contents[off:off+int64(len(b))], b) {
+				t.Errorf("%s message %d does not match contents at offset %d", file, i, off)
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+	}
+}
+
+func TestParserLogger(t *testing.T) {
+	contents := "From a@example.com Wed Jul  1 13:17:17 1998\n" +
+		"Subject: one\n" +
+		"\n" +
+		"From here on, a body line\n" +
+		"From b@example.com Wed Jul  1 13:17:17 1998\n" +
+		"not a header\n" +
+		"\n" +
+		"From c@example.com Wed Jul  1 13:17:17 1998\n" +
+		"Subject: two\n" +
+		"\n" +
+		"body\n"
+	want := []string{
+		"boundary detector detector=lenient",
+		"postmark not matched line=4",
+		"candidate postmark rejected line=5",
+		"message boundary line=8",
+	}
+
+	path := filepath.Join(t.TempDir(), "log.mbox")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	for _, reader := range []string{"io", "file"} {
+		var b bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		var mr mboxReader
+		if reader == "io" {
+			mr = NewMboxIOReader(strings.NewReader(contents), WithLogger(logger))
+		} else {
+			mr = NewMboxFileReader(f, WithLogger(logger))
+		}
+		if got, want := drain(mr, t), 2; got != want {
+			t.Errorf("%s reader got %d want %d messages", reader, got, want)
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			msg, attrs, _ := strings.Cut(line[strings.Index(line, "msg=")+len("msg="):], `" `)
+			got = append(got, strings.Trim(msg, `"`)+" "+strings.Fields(attrs)[0])
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s reader got log\n%s\nwant\n%s", reader, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package mailboxoperator
+
+// messages provides an iterator over the messages of several
+// mailboxes, for reading them without a MailboxOperator.
+
+import (
+	"io"
+	"iter"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// MessageSource is a mailbox providing an iterator over its messages,
+// such as *mbox.Mbox or *maildir.MailDir. Err reports the error which
+// stopped the iterator, if any.
+type MessageSource interface {
+	Messages() iter.Seq2[*mailfile.MailFile, io.Reader]
+	Err() error
+}
+
+// All returns an iterator over the messages of each of sources in
+// turn. Each reader is only valid until the iteration continues.
+// Iteration stops at the first source stopping with an error, reported
+// by its Err method. Sources which are io.Closers, such as *mbox.Mbox,
+// are closed once iteration ends, including those not reached when the
+// loop is left early.
+//
+//	for mf, r := range mailboxoperator.All(mb, md) {
+//		// do something with the io.Reader in r
+//	}
+//	if err := cmp.Or(mb.Err(), md.Err()); err != nil {
+//		...
+//	}
+func All(sources ...MessageSource) iter.Seq2[*mailfile.MailFile, io.Reader] {
+	return func(yield func(*mailfile.MailFile, io.Reader) bool) {
+		for i, s := range sources {
+			stopped := false
+			for mf, r := range s.Messages() {
+				if !yield(mf, r) {
+					stopped = true
+					break
+				}
+			}
+			if stopped || s.Err() != nil {
+				for _, s := range sources[i+1:] {
+					if c, ok := s.(io.Closer); ok {
+						_ = c.Close()
+					}
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package mailboxoperator
+
+import (
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/mailboxoperator/maildir"
+	"github.com/rorycl/mailboxoperator/mbox"
+)
+
+func TestAll(t *testing.T) {
+	open := func() (*mbox.Mbox, *maildir.MailDir) {
+		mb, err := mbox.NewMbox("mbox/testdata/golang.mbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := maildir.NewMailDir("maildir/testdata/example/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mb, md
+	}
+
+	mb, md := open()
+	kinds := map[string]int{}
+	for mf, r := range All(mb, md) {
+		if _, err := io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		kinds[mf.Kind]++
+	}
+	if mb.Err() != nil || md.Err() != nil {
+		t.Fatal(mb.Err(), md.Err())
+	}
+	if diff := cmp.Diff(map[string]int{"mbox": 2, "maildir": 6}, kinds); diff != "" {
+		t.Errorf("kinds diff %s", diff)
+	}
+
+	// breaking stops all sources
+	mb, md = open()
+	n := 0
+	for range All(mb, md) {
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	if m, _, err := md.NextReader(); err != nil || m.No != 1 {
+		t.Errorf("expected second maildir mail, got %v, %v", m, err)
+	}
+
+	// breaking closes the mboxes, including those not reached
+	mb, _ = open()
+	mb2, _ := open()
+	for range All(mb, mb2) {
+		break
+	}
+	for i, m := range []*mbox.Mbox{mb, mb2} {
+		if _, _, err := m.NextReader(); err != io.EOF {
+			t.Errorf("mbox %d: expected io.EOF once closed, got %v", i, err)
+		}
+	}
+}
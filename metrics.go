@@ -0,0 +1,172 @@
+package mailboxoperator
+
+// metrics provides instrumentation of a MailboxOperator through the
+// Metrics interface, with an expvar implementation.
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Metrics receives counters, histogram observations and gauges from a
+// MailboxOperator. The label values of each metric are given in the
+// order of the label names in its MetricDesc. Implementations must be
+// safe for concurrent use.
+//
+// The interface fits Prometheus clients: an adapter registers a
+// CounterVec, HistogramVec or GaugeVec for each of MetricDescs, and
+// calls WithLabelValues(labels...) with Add, Observe or Set.
+type Metrics interface {
+	Add(name string, v float64, labels ...string)     // add v to a counter
+	Observe(name string, v float64, labels ...string) // observe v in a histogram
+	Set(name string, v float64, labels ...string)     // set a gauge to v
+}
+
+// MetricType is the type of a metric.
+type MetricType int
+
+// The metric types.
+const (
+	CounterMetric MetricType = iota
+	HistogramMetric
+	GaugeMetric
+)
+
+// MetricDesc describes a metric published by a MailboxOperator.
+type MetricDesc struct {
+	Name    string
+	Help    string
+	Type    MetricType
+	Labels  []string
+	Buckets []float64 // histogram bucket upper bounds
+}
+
+// The names of the metrics published by a MailboxOperator.
+const (
+	MetricMessages         = "mailboxoperator_messages_total"
+	MetricBytes            = "mailboxoperator_bytes_total"
+	MetricErrors           = "mailboxoperator_errors_total"
+	MetricOperateSeconds   = "mailboxoperator_operate_seconds"
+	MetricMessageBytes     = "mailboxoperator_message_bytes"
+	MetricBusyWorkers      = "mailboxoperator_busy_workers"
+	MetricWaitingProducers = "mailboxoperator_waiting_producers"
+	MetricActiveSources    = "mailboxoperator_active_sources"
+)
+
+// MetricDescs describes the metrics published by a MailboxOperator.
+// The kind label is "mbox" or "maildir", and the error label of
+// MetricErrors is "operation", "panic", "timeout", "source" or
+// "worker". Workers that are all busy while producers wait show the
+// Operator to be the bottleneck, and idle workers show reading the
+// mailboxes to be.
+var MetricDescs = []MetricDesc{
+	{MetricMessages, "Messages read.", CounterMetric, []string{"kind"}, nil},
+	{MetricBytes, "Uncompressed message bytes read.", CounterMetric, []string{"kind"}, nil},
+	{MetricErrors, "Errors passed to the error handler.", CounterMetric, []string{"kind", "error"}, nil},
+	{MetricOperateSeconds, "Duration of calls to the Operator.", HistogramMetric, []string{"kind"},
+		[]float64{0.001, 0.01, 0.1, 1, 10, 60}},
+	{MetricMessageBytes, "Message size.", HistogramMetric, []string{"kind"},
+		[]float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20}},
+	{MetricBusyWorkers, "Workers running the Operator.", GaugeMetric, nil, nil},
+	{MetricWaitingProducers, "Messages read and waiting for a worker.", GaugeMetric, nil, nil},
+	{MetricActiveSources, "Mailboxes being read.", GaugeMetric, nil, nil},
+}
+
+// noMetrics is the default Metrics, which discards everything.
+type noMetrics struct{}
+
+func (noMetrics) Add(string, float64, ...string)     {}
+func (noMetrics) Observe(string, float64, ...string) {}
+func (noMetrics) Set(string, float64, ...string)     {}
+
+// errorLabel returns the MetricErrors kind and error label values for
+// an error passed to the OperatorErrorHandler.
+func errorLabel(err error) (kind, label string) {
+	var (
+		oe *OperationError
+		se *SourceError
+		pe *PanicError
+		we *WorkerError
+	)
+	switch {
+	case errors.As(err, &pe) && errors.As(err, &oe):
+		return oe.Kind, "panic"
+	case errors.Is(err, ErrOperateTimeout) && errors.As(err, &oe):
+		return oe.Kind, "timeout"
+	case errors.As(err, &oe):
+		return oe.Kind, "operation"
+	case errors.As(err, &se):
+		return se.Kind, "source"
+	case errors.As(err, &we):
+		return "", "worker"
+	}
+	return "", "other"
+}
+
+// ExpvarMetrics is a Metrics publishing to an expvar.Map. Each metric
+// is keyed by its name and label values, such as
+// "mailboxoperator_messages_total{mbox}". Histograms are maps of the
+// count and sum of observations and the cumulative count of each
+// bucket, keyed "le_" and the bucket upper bound.
+type ExpvarMetrics struct {
+	m       *expvar.Map
+	mu      sync.Mutex
+	buckets map[string][]float64
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics publishing to the expvar
+// name, which must not already be published.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	e := &ExpvarMetrics{m: expvar.NewMap(name), buckets: map[string][]float64{}}
+	for _, d := range MetricDescs {
+		e.buckets[d.Name] = d.Buckets
+	}
+	return e
+}
+
+// key returns the expvar key of a metric.
+func (e *ExpvarMetrics) key(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// Add adds v to a counter.
+func (e *ExpvarMetrics) Add(name string, v float64, labels ...string) {
+	e.m.AddFloat(e.key(name, labels), v)
+}
+
+// Observe records v in a histogram.
+func (e *ExpvarMetrics) Observe(name string, v float64, labels ...string) {
+	key := e.key(name, labels)
+	e.mu.Lock()
+	h, ok := e.m.Get(key).(*expvar.Map)
+	if !ok {
+		h = new(expvar.Map)
+		e.m.Set(key, h)
+	}
+	e.mu.Unlock()
+	h.Add("count", 1)
+	h.AddFloat("sum", v)
+	for _, b := range e.buckets[name] {
+		if v <= b {
+			h.Add(fmt.Sprintf("le_%g", b), 1)
+		}
+	}
+}
+
+// Set sets a gauge to v.
+func (e *ExpvarMetrics) Set(name string, v float64, labels ...string) {
+	f := new(expvar.Float)
+	f.Set(v)
+	e.m.Set(e.key(name, labels), f)
+}
+
+// String returns the published metrics as JSON.
+func (e *ExpvarMetrics) String() string {
+	return e.m.String()
+}
@@ -0,0 +1,123 @@
+package mailboxoperator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// maxGauges is a Metrics recording the maximum value of each gauge.
+type maxGauges struct {
+	noMetrics
+	sync.Mutex
+	max map[string]float64
+}
+
+func (m *maxGauges) Set(name string, v float64, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.max[name] = max(m.max[name], v)
+}
+
+// metricsTee passes metrics to each of a set of Metrics.
+type metricsTee []Metrics
+
+func (t metricsTee) Add(name string, v float64, labels ...string) {
+	for _, m := range t {
+		m.Add(name, v, labels...)
+	}
+}
+
+func (t metricsTee) Observe(name string, v float64, labels ...string) {
+	for _, m := range t {
+		m.Observe(name, v, labels...)
+	}
+}
+
+func (t metricsTee) Set(name string, v float64, labels ...string) {
+	for _, m := range t {
+		m.Set(name, v, labels...)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	e := NewExpvarMetrics("mailboxoperator_test")
+	g := &maxGauges{max: map[string]float64{}}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/missing.mbox"}
+	maildirs := []string{"maildir/testdata/example/"}
+
+	var s simple
+	mo, err := NewMailboxOperator(mboxes, maildirs, &s, NewErrorCollector().Handle, WithMetrics(metricsTee{e, g}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(e.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	mboxSize := float64(fileSizes(t, mboxes[0]))
+	maildirSize := float64(fileSizes(t, "maildir/testdata/example/*/*"))
+	for key, want := range map[string]float64{
+		MetricMessages + "{mbox}":            2,
+		MetricMessages + "{maildir}":         6,
+		MetricBytes + "{mbox}":               mboxSize,
+		MetricBytes + "{maildir}":            maildirSize,
+		MetricErrors + "{maildir,operation}": 1,
+		MetricErrors + "{mbox,source}":       1,
+		MetricBusyWorkers:                    0,
+		MetricWaitingProducers:               0,
+		MetricActiveSources:                  0,
+	} {
+		if got[key] != want {
+			t.Errorf("%s got %v want %v", key, got[key], want)
+		}
+	}
+	h, ok := got[MetricMessageBytes+"{maildir}"].(map[string]any)
+	if !ok {
+		t.Fatalf("no message size histogram in %v", got)
+	}
+	if h["count"] != 6.0 || h["sum"] != maildirSize || h["le_10240"] != 6.0 || h["le_1024"] != 2.0 {
+		t.Errorf("unexpected message size histogram %v", h)
+	}
+	if h, ok := got[MetricOperateSeconds+"{mbox}"].(map[string]any); !ok || h["count"] != 2.0 {
+		t.Errorf("unexpected operate latency histogram %v", h)
+	}
+
+	want := map[string]float64{
+		MetricBusyWorkers:      1,
+		MetricWaitingProducers: 1,
+		MetricActiveSources:    1,
+	}
+	for name, min := range want {
+		if g.max[name] < min {
+			t.Errorf("%s gauge max %v below %v", name, g.max[name], min)
+		}
+	}
+}
+
+func TestErrorLabel(t *testing.T) {
+	tests := []struct {
+		err         error
+		kind, label string
+	}{
+		{&OperationError{"mbox", "a", 1, errors.New("x")}, "mbox", "operation"},
+		{&OperationError{"mbox", "a", 1, &PanicError{Value: "x"}}, "mbox", "panic"},
+		{&OperationError{"maildir", "a", 1, fmt.Errorf("%w after 1s", ErrOperateTimeout)}, "maildir", "timeout"},
+		{&SourceError{"maildir", "a", PhaseOpen, errors.New("x")}, "maildir", "source"},
+		{errors.New("x"), "", "other"},
+	}
+	for i, tt := range tests {
+		kind, label := errorLabel(tt.err)
+		if diff := cmp.Diff([]string{tt.kind, tt.label}, []string{kind, label}); diff != "" {
+			t.Errorf("test %d (-want +got):\n%s", i, diff)
+		}
+	}
+}
@@ -2,9 +2,15 @@ package mailboxoperator
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
 
 	"github.com/rorycl/mailboxoperator/maildir"
 	"github.com/rorycl/mailboxoperator/mailfile"
@@ -20,6 +26,15 @@ type Operator interface {
 	Operate(io.Reader) error
 }
 
+// ContextOperator is an Operator which is passed a context by
+// OperateContext, used in place of Operate. The context is cancelled
+// when processing stops and carries the deadline set by
+// WithOperateTimeout, if any.
+type ContextOperator interface {
+	Operator
+	OperateContext(ctx context.Context, r io.Reader) error
+}
+
 var (
 	// WorkersNum is the number of concurrent workers used to process
 	// `Operator`.
@@ -29,34 +44,136 @@ var (
 // MailboxOperator is a struct setting out the mailboxes to be processed
 // with `Operator`.
 type MailboxOperator struct {
-	mboxes    []string
-	maildirs  []string
-	operator  Operator
-	opErrFunc func(error) error
+	mboxes      []string
+	maildirs    []string
+	operator    Operator
+	factory     OperatorFactory
+	merge       MergeFunc
+	sourceHooks SourceOperator
+	opErrFunc   func(error) error
+	mboxOpts    []mbox.Option
+	maildirOpts []maildir.Option
+	streaming   bool
+	budget      *budget
+	maxSize     int64
+	sizePolicy  SizePolicy
+	salvage     bool
+	quarantine  Quarantine
+	timeout     time.Duration
+
+	batchSize    int
+	batchLatency time.Duration
+
+	progress         ProgressFunc
+	progressInterval time.Duration
+	preScan          bool
+
+	logger  *slog.Logger
+	metrics Metrics
+	tracer  Tracer
 }
 
 // NewMailboxOperator creates a new MailboxOperator with the provided
-// one or more mbox format files or maildir directories.
-func NewMailboxOperator(mboxes []string, maildirs []string, operator Operator, oeh OperatorErrorHandler) (*MailboxOperator, error) {
+// one or more mbox format files or maildir directories, configured by
+// any options.
+func NewMailboxOperator(mboxes []string, maildirs []string, operator Operator, oeh OperatorErrorHandler, opts ...Option) (*MailboxOperator, error) {
 	if len(mboxes)+len(maildirs) < 1 {
 		return nil, errors.New("no mailboxes or maildirs provided")
 	}
 	if operator == nil {
 		return nil, errors.New("nil operator provided")
 	}
-	return &MailboxOperator{
+	m := &MailboxOperator{
 		mboxes:    mboxes,
 		maildirs:  maildirs,
 		operator:  operator,
 		opErrFunc: oeh,
-	}, nil
+		mboxOpts:  []mbox.Option{mbox.WithBufferReuse()}, // messages are copied before the next is read
+		logger:    slog.New(slog.DiscardHandler),
+		metrics:   noMetrics{},
+		tracer:    noTracer{},
+
+		batchSize:    defaultBatchSize,
+		batchLatency: defaultBatchLatency,
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	return m, nil
+}
+
+// OperatorFactory returns the Operator of the worker goroutine
+// workerID, from 0 to WorkersNum-1.
+type OperatorFactory func(workerID int) Operator
+
+// MergeFunc combines the Operators of the workers, in order of worker
+// id, at the end of a run.
+type MergeFunc func(ops []Operator) error
+
+// NewMailboxOperatorWithFactory creates a new MailboxOperator in the
+// manner of NewMailboxOperator, with an Operator for each worker made
+// by factory at the start of each run. Each Operator is only called by
+// its own worker, so it may hold state, such as counters or maps,
+// without locks, unless a call abandoned by WithOperateTimeout
+// continues to run. Once the workers have finished, merge, if not nil, is
+// called with the Operators to combine their state, even if processing
+// stopped with an error. The Operators' SourceOperator hooks are not
+// called; set them with WithSourceHooks.
+func NewMailboxOperatorWithFactory(mboxes []string, maildirs []string, factory OperatorFactory, merge MergeFunc, oeh OperatorErrorHandler, opts ...Option) (*MailboxOperator, error) {
+	if factory == nil {
+		return nil, errors.New("nil operator factory provided")
+	}
+	m, err := NewMailboxOperator(mboxes, maildirs, nopOperator{}, oeh, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m.operator, m.factory, m.merge = nil, factory, merge
+	return m, nil
+}
+
+// nopOperator is an Operator which does nothing.
+type nopOperator struct{}
+
+func (nopOperator) Operate(io.Reader) error { return nil }
+
+// operators returns the Operator of each worker, and the Operator
+// providing the SourceOperator hooks, if any.
+func (m *MailboxOperator) operators() ([]Operator, SourceOperator, error) {
+	ops := make([]Operator, WorkersNum)
+	for w := range ops {
+		ops[w] = m.operator
+		if m.factory != nil {
+			ops[w] = m.factory(w)
+		}
+		if ops[w] == nil {
+			return nil, nil, fmt.Errorf("nil operator from factory for worker %d", w)
+		}
+	}
+	if m.sourceHooks != nil || m.factory != nil {
+		return ops, m.sourceHooks, nil
+	}
+	unwrapped, _ := unwrapCounting([]Operator{m.operator})
+	hooks, _ := unwrapped[0].(SourceOperator)
+	return ops, hooks, nil
 }
 
-// Operate performs operations on the emails in each mailbox, exiting
-// with an error after the first error, if any. Each mailbox is
-// processed concurrently and the `Operator` function run by
-// `WorkersNum` goroutines.
+// Operate performs operations on the emails in each mailbox. Errors
+// from the `Operator` and from opening and reading mailboxes are passed
+// to the `OperatorErrorHandler`, and processing stops with the first
+// error it returns, if any. Processing also stops, without error, if
+// the `Operator` returns `ErrStop`. A panic in the `Operator` is
+// recovered and reported as an `OperationError` wrapping a
+// `PanicError`. Each mailbox is processed concurrently and the
+// `Operator` function run by `WorkersNum` goroutines.
 func (m *MailboxOperator) Operate() error {
+	_, err := m.process()
+	return err
+}
+
+// OperateReport performs operations on the emails in each mailbox in
+// the same way as Operate, returning a RunReport of the messages and
+// bytes read and processed, even if processing stops with an error.
+func (m *MailboxOperator) OperateReport() (*RunReport, error) {
 	return m.process()
 }
 
@@ -73,121 +190,541 @@ func (o *OperationError) Error() string {
 	return fmt.Sprintf("%s path:%s offset:%d error: %s", o.Kind, o.Path, o.Offset, o.Err.Error())
 }
 
+// Unwrap returns the underlying error.
+func (o *OperationError) Unwrap() error {
+	return o.Err
+}
+
+// SourceError is a decorated error describing the mbox/maildir path
+// and phase of an error opening or reading a mailbox, rather than from
+// a call to Operate.
+type SourceError struct {
+	Kind  string // mbox or maildir
+	Path  string // path to mbox or maildir
+	Phase string // PhaseOpen, PhaseRead or PhaseBuffer
+	Err   error
+}
+
+// The phases of processing a mailbox in which a SourceError may occur.
+const (
+	PhaseOpen   = "open"   // opening the mailbox
+	PhaseRead   = "read"   // reading the next message
+	PhaseBuffer = "buffer" // buffering a message for the workers
+)
+
+func (s *SourceError) Error() string {
+	return fmt.Sprintf("%s path:%s phase:%s error: %s", s.Kind, s.Path, s.Phase, s.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (s *SourceError) Unwrap() error {
+	return s.Err
+}
+
+// PanicError reports a panic recovered from a call to Operate. It is
+// passed to the OperatorErrorHandler wrapped in an OperationError.
+type PanicError struct {
+	Value    any                // the value passed to panic
+	Stack    []byte             // the stack trace of the panicking goroutine
+	MailFile *mailfile.MailFile // the mail being operated on
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", p.Value)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (p *PanicError) Unwrap() error {
+	if err, ok := p.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
 // mailBytesId passes mail data from the reader to the worker
 type mailBytesId struct {
-	m   *mailfile.MailFile
-	buf *bytes.Buffer
-	i   int // this email offset
+	m    *mailfile.MailFile
+	buf  *bytes.Buffer
+	r    io.Reader     // streamed mail data, used if buf is nil
+	done chan struct{} // closed by the worker after using r
+	i    int           // this email offset
+	size int64         // memory budget held by buf
+	ctx  context.Context
+	span Span // the message span, ended by the worker
+}
+
+// reader returns the mail data.
+func (mbi mailBytesId) reader() io.Reader {
+	if mbi.buf == nil {
+		return mbi.r
+	}
+	return mbi.buf
+}
+
+// truncatingReader reads a streamed message, reporting the end of a
+// message truncated at the maximum message size as io.EOF.
+type truncatingReader struct {
+	r io.Reader
+}
+
+// Read reads from the underlying reader, replacing ErrMessageTooLarge
+// with io.EOF.
+func (t truncatingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if errors.Is(err, ErrMessageTooLarge) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// errorHandler serialises calls to the OperatorErrorHandler from the
+// producers and workers. The first error returned by the handler is
+// recorded and cancels processing.
+type errorHandler struct {
+	sync.Mutex
+	handle  OperatorErrorHandler
+	cancel  context.CancelFunc
+	err     error
+	stopped bool // processing was stopped by ErrStop
+	logger  *slog.Logger
+	metrics Metrics
+}
+
+// report passes err to the OperatorErrorHandler, returning the error
+// stopping processing, if any. Once processing has been stopped by
+// ErrStop, errors caused by the cancellation, such as those of
+// ContextOperators returning ctx.Err(), are not passed on.
+func (e *errorHandler) report(err error) error {
+	e.Lock()
+	defer e.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	if e.stopped && errors.Is(err, context.Canceled) {
+		return nil
+	}
+	kind, label := errorLabel(err)
+	e.metrics.Add(MetricErrors, 1, kind, label)
+	if herr := e.handle(err); herr != nil {
+		e.logger.Error("error handler stopped processing", "error", herr)
+		e.err = herr
+		e.cancel()
+		return herr
+	}
+	e.logger.Warn("error handled, continuing", "error", err)
+	return nil
+}
+
+// fail passes err to the OperatorErrorHandler and stops processing
+// with the error it returns or, if none, with err.
+func (e *errorHandler) fail(err error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.err != nil {
+		return
+	}
+	kind, label := errorLabel(err)
+	e.metrics.Add(MetricErrors, 1, kind, label)
+	e.err = cmp.Or(e.handle(err), err)
+	e.logger.Error("error stopped processing", "error", e.err)
+	e.cancel()
 }
 
-// workers process mail on the reader chan with the Operator.
-func (m *MailboxOperator) workers(reader <-chan mailBytesId) <-chan error {
+// stop cancels processing without error.
+func (e *errorHandler) stop() {
+	e.Lock()
+	defer e.Unlock()
+	e.logger.Info("operator stopped processing")
+	e.stopped = true
+	e.cancel()
+}
+
+// Err returns the error stopping processing, if any.
+func (e *errorHandler) Err() error {
+	e.Lock()
+	defer e.Unlock()
+	return e.err
+}
 
-	workerErrChan := make(chan error)
+// workers process mail on the reader chan with the Operator until the
+// chan is closed, or batches of mail on the batches chan, if not nil,
+// with a BatchOperator, calling the hooks of a WorkerOperator. Once
+// processing is cancelled the remaining mail is drained without being
+// processed.
+func (m *MailboxOperator) workers(ctx context.Context, h *errorHandler, st *runStats, ops []Operator, reader <-chan mailBytesId, batches <-chan []mailBytesId) *errgroup.Group {
 	g := new(errgroup.Group)
-	for w := 0; w < WorkersNum; w++ {
+	for w, op := range ops {
 		g.Go(func() error {
+			if wo, ok := op.(WorkerOperator); ok {
+				if err := wo.WorkerInit(w); err != nil {
+					h.fail(&WorkerError{w, PhaseWorkerInit, err})
+				} else {
+					defer func() {
+						if err := wo.WorkerDone(w); err != nil {
+							_ = h.report(&WorkerError{w, PhaseWorkerDone, err})
+						}
+					}()
+				}
+			}
+			if batches != nil {
+				for b := range batches {
+					m.operateBatch(ctx, h, st, op.(BatchOperator), b)
+				}
+				return nil
+			}
 			for mbi := range reader {
-				// run the operator
-				err := m.operator.Operate(mbi.buf)
-				if err != nil {
-					thisErr := &OperationError{mbi.m.Kind, mbi.m.Path, mbi.m.No, err}
-					workerErrChan <- thisErr
-					// don't error; defer to
+				// run the operator, retaining the buffered message
+				// for quarantine
+				var (
+					err  error
+					data []byte
+				)
+				if mbi.buf != nil {
+					data = mbi.buf.Bytes()
+				}
+				operated := ctx.Err() == nil
+				if operated {
+					st.gauge(MetricBusyWorkers, &st.busy, 1)
+					start := time.Now()
+					octx, span := m.tracer.Start(mbi.ctx, SpanOperate, mailFileAttrs(mbi.m)...)
+					err = m.operate(octx, op, mbi)
+					if err != nil {
+						span.RecordError(err)
+					}
+					span.End()
+					m.metrics.Observe(MetricOperateSeconds, time.Since(start).Seconds(), mbi.m.Kind)
+					st.gauge(MetricBusyWorkers, &st.busy, -1)
+				}
+				if errors.Is(err, ErrStop) {
+					h.stop()
+					err = nil
 				}
+				m.finish(h, st, mbi, operated, data, true, err)
 			}
 			return nil
 		})
 	}
-	go func() {
-		workerErrChan <- g.Wait()
-		close(workerErrChan)
+	return g
+}
+
+// finish records the result of operating on mbi, or of skipping it if
+// not operated, quarantining data if the Operator returned err. The
+// buffer of mbi is returned to the pool if reuse is set.
+func (m *MailboxOperator) finish(h *errorHandler, st *runStats, mbi mailBytesId, operated bool, data []byte, reuse bool, err error) {
+	if operated {
+		for _, t := range st.counters {
+			t.count()
+		}
+	}
+	st.add(mbi.i, func(r *SourceReport) {
+		if operated {
+			r.Operated++
+		} else {
+			r.Skipped++
+		}
+		if err != nil {
+			r.Errors++
+		}
+	})
+	var qErr error
+	if err != nil && m.quarantine != nil && data != nil {
+		qErr = quarantine(m.quarantine, mbi.m, data, err)
+	}
+	if mbi.done != nil {
+		close(mbi.done)
+	}
+	if reuse {
+		putBuffer(mbi.buf)
+	}
+	m.budget.release(mbi.size)
+	mbi.span.End()
+	if err != nil {
+		_ = h.report(&OperationError{mbi.m.Kind, mbi.m.Path, mbi.m.No, err})
+	}
+	if qErr != nil {
+		_ = h.report(&OperationError{mbi.m.Kind, mbi.m.Path, mbi.m.No, qErr})
+	}
+}
+
+// call runs op on the mail mf read from r, passing ctx to a
+// ContextOperator and recovering any panic as a PanicError.
+func call(ctx context.Context, op Operator, mf *mailfile.MailFile, r io.Reader) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack(), MailFile: mf}
+		}
 	}()
-	return workerErrChan
+	switch o := op.(type) {
+	case mailFileOperator:
+		return o.operateMailFile(ctx, mf, r)
+	case ContextOperator:
+		return o.OperateContext(ctx, r)
+	}
+	return op.Operate(r)
+}
+
+// readNextMail is a common interface for mbox, maildir reading
+type readNextMail interface {
+	NextReader() (*mailfile.MailFile, io.Reader, error)
+}
+
+// source is an mbox or maildir to be read.
+type source struct {
+	kind, path string
+	mail       readNextMail
 }
 
 // process processes all mailboxes and maildirs in separate goroutines
-// for each feeding the emails to the workers func over the reader chan.
-func (m *MailboxOperator) process() error {
+// for each feeding the emails to the workers func over the reader chan,
+// returning a RunReport of the run.
+func (m *MailboxOperator) process() (rr *RunReport, err error) {
 
-	// readNextMail is a common interface for mbox, maildir reading
-	type readNextMail interface {
-		NextReader() (*mailfile.MailFile, io.Reader, error)
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx, span := m.tracer.Start(ctx, SpanRun, Attribute{AttrMailboxes, len(m.mboxes) + len(m.maildirs)})
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+	ops, hooks, err := m.operators()
+	if err != nil {
+		return newRunStats(start, nil).report(), err
 	}
+	// merge the Operators however the run ends, once the workers have
+	// finished
+	defer func() {
+		if m.merge == nil {
+			return
+		}
+		if merr := m.merge(ops); merr != nil && err == nil {
+			err = fmt.Errorf("merge error: %w", merr)
+		}
+	}()
+	h := &errorHandler{handle: m.opErrFunc, cancel: cancel, logger: m.logger, metrics: m.metrics}
 
-	allMboxesAndMailDirs := []readNextMail{}
-	for _, m := range m.mboxes {
-		b, err := mbox.NewMbox(m)
+	// mailboxes which cannot be opened are reported to the handler
+	sources := []source{}
+	for _, path := range m.mboxes {
+		b, err := mbox.NewMbox(path, m.mboxOpts...)
 		if err != nil {
-			return fmt.Errorf("register mbox error: %w", err)
+			if err := h.report(&SourceError{"mbox", path, PhaseOpen, err}); err != nil {
+				closeSources(sources)
+				return newRunStats(start, sources).report(), err
+			}
+			continue
 		}
-		allMboxesAndMailDirs = append(allMboxesAndMailDirs, b)
+		m.logger.Info("mailbox opened", "kind", "mbox", "path", path)
+		sources = append(sources, source{"mbox", path, b})
 	}
-	for _, m := range m.maildirs {
-		b, err := maildir.NewMailDir(m)
+	for _, path := range m.maildirs {
+		b, err := maildir.NewMailDir(path, m.maildirOpts...)
 		if err != nil {
-			return fmt.Errorf("register maildir error: %w", err)
+			if err := h.report(&SourceError{"maildir", path, PhaseOpen, err}); err != nil {
+				closeSources(sources)
+				return newRunStats(start, sources).report(), err
+			}
+			continue
 		}
-		allMboxesAndMailDirs = append(allMboxesAndMailDirs, b)
+		m.logger.Info("mailbox opened", "kind", "maildir", "path", path)
+		sources = append(sources, source{"maildir", path, b})
 	}
 
 	// reader is a chan for sending emails to workers
 	reader := make(chan mailBytesId)
+	st := newRunStats(start, sources)
+	st.metrics = m.metrics
+	run, counters := unwrapCounting(ops)
+	st.hooks, st.counters = hooks, counters
+	if m.progress != nil {
+		st.progress, st.interval = m.progress, m.progressInterval
+		st.states = m.progressTotals(sources)
+	}
 
-	// initiate email operator workers
-	workerErrChan := m.workers(reader)
+	// initiate email operator workers, with batches for a BatchOperator
+	var batches chan []mailBytesId
+	if m.batching(run) {
+		batches = make(chan []mailBytesId)
+		go m.batch(reader, batches)
+	}
+	workers := m.workers(ctx, h, st, run, reader, batches)
 
-	// Read each mbox/maildir in a separate goroutine, exiting on first
-	// error. Errors from workers are signalled on the workerErrChan,
-	// with the first worker error being reported after which the
-	// workerErrChan is closed, causing other producer goroutines to
-	// exit.
+	// Read each mbox/maildir in a separate goroutine. Errors are
+	// passed to the handler, and the first error it returns cancels
+	// processing, causing the producers to exit.
 	g := new(errgroup.Group)
-	for i, mm := range allMboxesAndMailDirs {
+	for i, s := range sources {
 		g.Go(func() error {
-			for {
-				// check for error or closed worker chan, exiting in
-				// either case
-				select {
-				case err, ok := <-workerErrChan:
-					if err != nil {
-						// wrap error with the customised error func,
-						// which may return nil or an err
-						if err2 := m.opErrFunc(err); err2 != nil {
-							return err2
-						}
-					}
-					if !ok {
-						return nil
-					}
-				default:
-				}
+			return m.produce(ctx, h, st, reader, s, i)
+		})
+	}
+	_ = g.Wait()
+	close(reader) // signal completion to workers
 
-				n, r, err := mm.NextReader()
-				if err != nil && err == io.EOF {
-					break
-				}
-				if err != nil {
-					return fmt.Errorf("read next mail error: %w", err)
+	// wait for workers to complete
+	_ = workers.Wait()
+	err = h.Err()
+	report := st.report()
+	m.logger.Info("run complete", "messages", report.Read, "errors", report.Errors, "skipped", report.Skipped, "duration", report.Duration)
+	return report, err
+}
+
+// closeSources closes the sources, such as mboxes, which hold open
+// files, for a run stopped before they are read.
+func closeSources(sources []source) {
+	for _, s := range sources {
+		if c, ok := s.mail.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
+
+// produce reads the emails from source s, sending them to the workers
+// over the reader chan until the source is exhausted or processing is
+// cancelled, returning the error stopping reading, if any. The
+// messages and bytes read are recorded in st.
+func (m *MailboxOperator) produce(ctx context.Context, h *errorHandler, st *runStats, reader chan<- mailBytesId, s source, i int) (err error) {
+	start := time.Now()
+	ctx, span := m.tracer.Start(ctx, SpanSource, Attribute{AttrKind, s.kind}, Attribute{AttrPath, s.path})
+	defer span.End()
+	defer closeSources([]source{s}) // if not read to the end
+	st.begin(i)
+	if st.hooks != nil {
+		st.hooks.SourceStart(&mailfile.MailFile{Kind: s.kind, Path: s.path})
+	}
+	st.gauge(MetricActiveSources, &st.active, 1)
+	defer st.gauge(MetricActiveSources, &st.active, -1)
+	var msgBytes int64 // bytes of the messages read
+	complete := false  // the source was read to the end
+	var handled error  // the last read error passed to the handler
+	defer func() {
+		if err == nil && !complete {
+			err = ctx.Err()
+		}
+		endErr := err
+		if endErr == nil {
+			endErr = handled
+		}
+		st.finish(i, s, time.Since(start), msgBytes, endErr)
+		m.logger.Info("mailbox read", "kind", s.kind, "path", s.path, "duration", time.Since(start))
+	}()
+	skip := func(r *SourceReport) { r.Skipped++ }
+
+	for ctx.Err() == nil {
+		_, rspan := m.tracer.Start(ctx, SpanRead)
+		readTime := s.readTime()
+		n, r, err := s.mail.NextReader()
+		if n != nil {
+			rspan.SetAttributes(mailFileAttrs(n)...)
+		}
+		rspan.SetAttributes(Attribute{AttrReadSeconds, (s.readTime() - readTime).Seconds()})
+		if err != nil && err != io.EOF {
+			rspan.RecordError(err)
+		}
+		rspan.End()
+		if err != nil && err == io.EOF {
+			complete = true
+			break
+		}
+		// when salvaging, report the partial message and continue
+		// with the other mailboxes. In streaming mode the partial
+		// message, without a reader, has already been read and
+		// passed to a worker.
+		var readErr *ReadError
+		if m.salvage && errors.As(err, &readErr) {
+			if r != nil {
+				st.read(i, s, n)
+				st.add(i, skip)
+			}
+			if herr := h.report(&OperationError{n.Kind, n.Path, n.No, err}); herr != nil {
+				return herr
+			}
+			return err
+		}
+		if err != nil {
+			span.RecordError(err)
+			if herr := h.report(&SourceError{s.kind, s.path, PhaseRead, err}); herr != nil {
+				return herr
+			}
+			handled = err
+			continue
+		}
+		st.read(i, s, n)
+		mctx, mspan := m.tracer.Start(ctx, SpanMessage, mailFileAttrs(n)...)
+
+		// in streaming mode hand the source reader to a worker and
+		// wait for it to be used before reading further
+		if m.streaming {
+			done := make(chan struct{})
+			cr := &countingReader{r: r}
+			sr := io.Reader(cr)
+			if m.maxSize > 0 && m.sizePolicy == TruncateLargeMessages {
+				sr = truncatingReader{cr}
+			}
+			if st.send(ctx, reader, mailBytesId{m: n, r: sr, done: done, i: i, ctx: mctx, span: mspan}) {
+				<-done
+			} else {
+				mspan.End()
+				st.add(i, skip)
+			}
+			msgBytes += cr.n
+			st.messageBytes(s.kind, cr.n)
+			if c, ok := r.(io.Closer); ok {
+				_ = c.Close()
+			}
+			continue
+		}
+
+		// read the mail into a pooled buffer
+		b := getBuffer()
+		_, bspan := m.tracer.Start(mctx, SpanBuffer)
+		_, err = b.ReadFrom(r)
+		bspan.SetAttributes(Attribute{AttrMessageBytes, b.Len()})
+		if err != nil {
+			bspan.RecordError(err)
+		}
+		bspan.End()
+		msgBytes += int64(b.Len())
+		st.messageBytes(s.kind, int64(b.Len()))
+		if c, ok := r.(io.Closer); ok {
+			_ = c.Close()
+		}
+		if errors.Is(err, ErrMessageTooLarge) {
+			err = nil
+			if m.sizePolicy != TruncateLargeMessages {
+				putBuffer(b)
+				mspan.End()
+				st.add(i, skip)
+				if m.sizePolicy == ReportLargeMessages {
+					err = h.report(&OperationError{n.Kind, n.Path, n.No, ErrMessageTooLarge})
 				}
-				b := bytes.Buffer{}
-				_, err = b.ReadFrom(r)
 				if err != nil {
-					return fmt.Errorf("buffer error: %w", err)
+					return err
 				}
-				reader <- mailBytesId{n, &b, i}
+				continue
 			}
-			return nil
-		})
-	}
-	err := g.Wait()
-	if err != nil {
-		return err
+		}
+		if err != nil {
+			putBuffer(b)
+			mspan.End()
+			span.RecordError(err)
+			st.add(i, skip)
+			if herr := h.report(&SourceError{s.kind, s.path, PhaseBuffer, err}); herr != nil {
+				return herr
+			}
+			handled = err
+			continue
+		}
+		// block while the memory budget, if any, is exhausted
+		size := m.budget.acquire(int64(b.Len()))
+		if !st.send(ctx, reader, mailBytesId{m: n, buf: b, i: i, size: size, ctx: mctx, span: mspan}) {
+			putBuffer(b)
+			m.budget.release(size)
+			mspan.End()
+			st.add(i, skip)
+		}
 	}
-	close(reader) // signal completion to workers
-
-	// wait for workers to complete, possibly with error, if not
-	// completed already
-	err = <-workerErrChan
-	return err
+	return nil
 }
@@ -1,14 +1,28 @@
 package mailboxoperator
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/mailboxoperator/maildir"
+	"github.com/rorycl/mailboxoperator/mbox/parser"
+	"github.com/rorycl/mailboxoperator/uncompress"
 )
 
 type counter struct {
@@ -169,3 +183,722 @@ func TestNewMailboxOperator(t *testing.T) {
 		t.Fatal("expected nil operator error", err)
 	}
 }
+
+func TestProcessBoundaryDetector(t *testing.T) {
+	tests := []struct {
+		detector parser.BoundaryDetector
+		want     int
+	}{
+		{parser.LenientDetector, 1},
+		{parser.GrepmailDetector, 3},
+	}
+	for _, tt := range tests {
+		c := counter{}
+		mo, err := NewMailboxOperator([]string{"mbox/testdata/list.mbox"}, nil, &c, oeh, WithBoundaryDetector(tt.detector))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := c.num, tt.want; got != want {
+			t.Errorf("%v got %d want %d", tt.detector, got, want)
+		}
+	}
+}
+
+// bodyCounter counts messages and the body bytes passed to it.
+type bodyCounter struct {
+	num, body int
+	sync.Mutex
+}
+
+func (b *bodyCounter) Operate(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.num++
+	b.body += len(body)
+	return nil
+}
+
+func TestProcessHeadersOnly(t *testing.T) {
+	b := bodyCounter{}
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	mo, err := NewMailboxOperator(mboxes, maildirs, &b, oeh, WithHeadersOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.num, 9; got != want {
+		t.Errorf("got %d want %d messages", got, want)
+	}
+	if got, want := b.body, 0; got != want {
+		t.Errorf("got %d want %d body bytes", got, want)
+	}
+}
+
+func TestProcessStreaming(t *testing.T) {
+	b := bodyCounter{}
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	mo, err := NewMailboxOperator(mboxes, maildirs, &b, oeh, WithStreaming())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.num, 9; got != want {
+		t.Errorf("got %d want %d messages", got, want)
+	}
+
+	var s simple
+	mo, err = NewMailboxOperator(mboxes, maildirs, &s, oeh, WithStreaming())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oe *OperationError
+	if err := mo.Operate(); !errors.As(err, &oe) {
+		t.Fatalf("expected OperationError, got %T for %s", err, err)
+	}
+}
+
+func TestProcessMemoryBudget(t *testing.T) {
+	c := counter{}
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	// the budget is smaller than most of the messages
+	mo, err := NewMailboxOperator(mboxes, maildirs, &c, oeh, WithMemoryBudget(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.num, 9; got != want {
+		t.Errorf("got %d want %d", got, want)
+	}
+}
+
+// sizer records the size of each message.
+type sizer struct {
+	sizes []int
+	sync.Mutex
+}
+
+func (s *sizer) Operate(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.sizes = append(s.sizes, len(b))
+	return nil
+}
+
+func TestProcessMaxMessageSize(t *testing.T) {
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	tests := []struct {
+		policy    SizePolicy
+		streaming bool
+		messages  int
+		errors    int
+	}{
+		{SkipLargeMessages, false, 4, 0},
+		{TruncateLargeMessages, false, 9, 0},
+		{ReportLargeMessages, false, 4, 5},
+		{TruncateLargeMessages, true, 9, 0},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			s := sizer{}
+			var mu sync.Mutex
+			errs := 0
+			handler := func(err error) error {
+				if !errors.Is(err, ErrMessageTooLarge) {
+					return err
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				errs++
+				return nil
+			}
+			opts := []Option{WithMaxMessageSize(2000, tt.policy)}
+			if tt.streaming {
+				opts = append(opts, WithStreaming())
+			}
+			mo, err := NewMailboxOperator(mboxes, maildirs, &s, handler, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mo.Operate(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(s.sizes), tt.messages; got != want {
+				t.Errorf("messages got %d want %d", got, want)
+			}
+			if got, want := errs, tt.errors; got != want {
+				t.Errorf("errors got %d want %d", got, want)
+			}
+			for _, size := range s.sizes {
+				if size > 2000 {
+					t.Errorf("message size %d over maximum", size)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDecompressionLimits(t *testing.T) {
+	c := counter{}
+	mboxes := []string{"mbox/testdata/golang.mbox.bz2"}
+
+	mo, err := NewMailboxOperator(mboxes, nil, &c, oeh, WithDecompressionLimits(1000, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mo.Operate()
+	var le *uncompress.LimitError
+	if !errors.As(err, &le) {
+		t.Fatalf("expected LimitError, got %T for %v", err, err)
+	}
+
+	mo, err = NewMailboxOperator(mboxes, nil, &c, oeh, WithDecompressionLimits(1<<20, 100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.num, 2; got != want {
+		t.Errorf("got %d want %d", got, want)
+	}
+}
+
+func TestProcessParallelDecompression(t *testing.T) {
+	c := counter{}
+	mboxes := []string{"mbox/testdata/golang.mbox.bz2", "uncompress/testdata/golang.blocks.mbox.xz"}
+
+	mo, err := NewMailboxOperator(mboxes, nil, &c, oeh, WithParallelDecompression(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.num, 4; got != want {
+		t.Errorf("got %d want %d", got, want)
+	}
+}
+
+func TestProcessSalvage(t *testing.T) {
+	// mailarc-1.txt.gz is truncated part way through
+	contents, err := os.ReadFile("mbox/parser/testdata/mailarc-1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	if _, err := gw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	damaged := filepath.Join(t.TempDir(), "mailarc-1.txt.gz")
+	if err := os.WriteFile(damaged, b.Bytes()[:b.Len()*9/10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	mboxes := []string{damaged, "mbox/testdata/golang.mbox"}
+
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streaming_%t", streaming), func(t *testing.T) {
+			// 15 of 16 messages of the damaged mbox are complete, and
+			// in streaming mode the partial message is also passed to
+			// the Operator, which reads only its headers
+			want := 15 + 2
+			opts := []Option{WithSalvage()}
+			if streaming {
+				want++
+				opts = append(opts, WithStreaming())
+			}
+
+			// without salvage the run stops with an error
+			mo, err := NewMailboxOperator(mboxes, nil, &counter{}, oeh, opts[1:]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mo.Operate(); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+			}
+
+			c := counter{}
+			var errs []error
+			var mu sync.Mutex
+			collect := func(err error) error {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+				return nil
+			}
+			mo, err = NewMailboxOperator(mboxes, nil, &c, collect, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr, err := mo.OperateReport()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.num; got != want {
+				t.Errorf("got %d want %d messages", got, want)
+			}
+			// the partial message is read once, and skipped unless
+			// streamed
+			src := rr.Sources[0]
+			if src.Read != 16 || src.Operated != want-2 || src.Read != src.Operated+src.Skipped {
+				t.Errorf("got %d read, %d operated, %d skipped", src.Read, src.Operated, src.Skipped)
+			}
+			var readErrs []*ReadError
+			for _, err := range errs {
+				var oe *OperationError
+				var re *ReadError
+				if !errors.As(err, &oe) || !errors.As(err, &re) {
+					continue
+				}
+				if oe.Path != damaged || oe.Offset != 15 {
+					t.Errorf("unexpected OperationError %v", oe)
+				}
+				readErrs = append(readErrs, re)
+			}
+			if len(readErrs) != 1 {
+				t.Fatalf("expected one ReadError, got %v", errs)
+			}
+			if re := readErrs[0]; re.Offset <= 0 || re.Position <= re.Offset {
+				t.Errorf("unexpected ReadError positions %d %d", re.Offset, re.Position)
+			}
+		})
+	}
+}
+
+func TestProcessSourceErrors(t *testing.T) {
+	// an empty maildir, and a maildir with a message which cannot be
+	// opened
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	broken := filepath.Join(dir, "broken")
+	for _, md := range []string{empty, broken} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(md, sub), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(broken, "cur", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/empty", "mbox/testdata/missing.mbox"}
+	maildirs := []string{"maildir/testdata/example/", empty, broken}
+
+	// the fatal handler stops at the first error
+	mo, err := NewMailboxOperator(mboxes, maildirs, &counter{}, OpErrFatalHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var se *SourceError
+	if err := mo.Operate(); !errors.As(err, &se) || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected SourceError wrapping io.EOF, got %v", err)
+	}
+
+	// other handlers may skip the failing mailboxes
+	c := counter{}
+	var sourceErrs []*SourceError
+	var mu sync.Mutex
+	collect := func(err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		var se *SourceError
+		if !errors.As(err, &se) {
+			return err
+		}
+		sourceErrs = append(sourceErrs, se)
+		return nil
+	}
+	mo, err = NewMailboxOperator(mboxes, maildirs, &c, collect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.num, 2+6; got != want {
+		t.Errorf("got %d want %d messages", got, want)
+	}
+	var got []string
+	for _, se := range sourceErrs {
+		got = append(got, se.Kind+" "+filepath.Base(se.Path)+" "+se.Phase)
+	}
+	slices.Sort(got)
+	want := []string{"maildir broken read", "maildir empty open", "mbox empty open", "mbox missing.mbox open"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("source errors mismatch (-want +got):\n%s", diff)
+	}
+	if !errors.Is(sourceErrs[slices.IndexFunc(sourceErrs, func(se *SourceError) bool {
+		return filepath.Base(se.Path) == "empty" && se.Kind == "maildir"
+	})], maildir.ErrEmptyMailDir) {
+		t.Error("expected ErrEmptyMailDir")
+	}
+}
+
+// panicker is an Operator which panics on messages from the maildir.
+type panicker struct {
+	counter
+}
+
+func (p *panicker) Operate(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("koi8-r")) {
+		panic(errors.New("malformed charset"))
+	}
+	if bytes.Contains(b, []byte("Subject: Re: [go-nuts]")) {
+		panic("unexpected reply")
+	}
+	return p.counter.Operate(bytes.NewReader(b))
+}
+
+func TestProcessPanic(t *testing.T) {
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/gonuts.mbox"}
+
+	c := NewErrorCollector()
+	p := &panicker{}
+	mo, err := NewMailboxOperator(mboxes, maildirs, p, c.Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	errs := c.Errors()
+	if got, want := len(errs), 2; got != want {
+		t.Fatalf("got %d want %d errors: %v", got, want, errs)
+	}
+	if got, want := p.num, 5; got != want {
+		t.Errorf("got %d want %d messages", got, want)
+	}
+	for _, err := range errs {
+		var (
+			oe *OperationError
+			pe *PanicError
+		)
+		if !errors.As(err, &oe) || !errors.As(err, &pe) {
+			t.Fatalf("expected OperationError wrapping PanicError, got %v", err)
+		}
+		if pe.MailFile == nil || pe.MailFile.Path != oe.Path || pe.MailFile.No != oe.Offset {
+			t.Errorf("unexpected panic MailFile %v for %v", pe.MailFile, oe)
+		}
+		if !bytes.Contains(pe.Stack, []byte("panicker")) {
+			t.Errorf("stack does not include the panicking operator:\n%s", pe.Stack)
+		}
+		switch oe.Kind {
+		case "maildir":
+			if pe.Unwrap() == nil || err.Error() != oe.Kind+" path:"+oe.Path+" offset:3 error: panic: malformed charset" {
+				t.Errorf("unexpected maildir panic error %q", err)
+			}
+		case "mbox":
+			if pe.Unwrap() != nil || pe.Value != "unexpected reply" {
+				t.Errorf("unexpected mbox panic value %v", pe.Value)
+			}
+		}
+	}
+}
+
+// idFinder is an Operator which stops processing once the message with
+// Message-ID id is found.
+type idFinder struct {
+	id    string
+	found bool
+	counter
+}
+
+func (f *idFinder) Operate(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.num++
+	if msg.Header.Get("Message-ID") == f.id {
+		f.found = true
+		return ErrStop
+	}
+	return nil
+}
+
+func TestProcessStop(t *testing.T) {
+	const total = 500
+	var b bytes.Buffer
+	for i := range total {
+		fmt.Fprintf(&b, "From sender@example.com Thu Jan  1 00:00:00 2015\nFrom: sender@example.com\nMessage-ID: <%d@example.com>\n\nmessage %d\n\n", i, i)
+	}
+	path := filepath.Join(t.TempDir(), "many.mbox")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streaming := range []bool{false, true} {
+		var opts []Option
+		if streaming {
+			opts = append(opts, WithStreaming())
+		}
+		f := &idFinder{id: "<10@example.com>"}
+		mo, err := NewMailboxOperator([]string{path}, nil, f, oeh, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatalf("streaming %t: unexpected error %v", streaming, err)
+		}
+		if !f.found {
+			t.Errorf("streaming %t: message not found", streaming)
+		}
+		if f.num >= total {
+			t.Errorf("streaming %t: processing not stopped, %d messages processed", streaming, f.num)
+		}
+	}
+}
+
+// ctxStopper is a ContextOperator of which the first call returns
+// ErrStop after a delay, while the others wait for their context to be
+// done.
+type ctxStopper struct {
+	once sync.Once
+}
+
+func (c *ctxStopper) Operate(r io.Reader) error {
+	return c.OperateContext(context.Background(), r)
+}
+
+func (c *ctxStopper) OperateContext(ctx context.Context, r io.Reader) error {
+	first := false
+	c.once.Do(func() { first = true })
+	if first {
+		time.Sleep(20 * time.Millisecond)
+		return ErrStop
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestProcessStopContext(t *testing.T) {
+	// the cancellation of the other calls in flight is not an error
+	mo, err := NewMailboxOperator(nil, []string{"maildir/testdata/example/"}, &ctxStopper{}, OpErrFatalHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestProcessStopCloses(t *testing.T) {
+	// streams.mbox.bz2 holds 40 concatenated bzip2 streams
+	bz, err := os.ReadFile("mbox/testdata/golang.mbox.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := filepath.Join(t.TempDir(), "streams.mbox.bz2")
+	if err := os.WriteFile(streams, bytes.Repeat(bz, 40), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// stopped runs close the mboxes, stopping parallel decompression
+	mboxes := []string{streams, "mbox/testdata/missing.mbox"}
+	before := runtime.NumGoroutine()
+	for range 5 {
+		mo, err := NewMailboxOperator(mboxes[:1], nil, &ctxStopper{}, OpErrFatalHandler, WithParallelDecompression(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatal(err)
+		}
+		// the run stops opening the mailboxes
+		mo, err = NewMailboxOperator(mboxes, nil, &ctxStopper{}, OpErrFatalHandler, WithParallelDecompression(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err == nil {
+			t.Fatal("expected open error")
+		}
+	}
+	for range 100 {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("got %d goroutines, %d before the runs", runtime.NumGoroutine(), before)
+}
+
+func TestProcessLogger(t *testing.T) {
+	var b bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	mboxes := []string{"mbox/testdata/golang.mbox.bz2", "mbox/testdata/missing.mbox"}
+	maildirs := []string{"maildir/testdata/example/"}
+
+	var s simple
+	mo, err := NewMailboxOperator(mboxes, maildirs, &s, NewErrorCollector().Handle, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int{}
+	dec := json.NewDecoder(&b)
+	for dec.More() {
+		var rec struct {
+			Level string
+			Msg   string
+			Type  string
+		}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		key := rec.Level + " " + rec.Msg
+		if rec.Type != "" {
+			key += " " + rec.Type
+		}
+		got[key]++
+	}
+	want := map[string]int{
+		"INFO mailbox opened":                            2,
+		"INFO mailbox read":                              2,
+		"INFO run complete":                              1,
+		"WARN error handled, continuing":                 2,
+		"DEBUG mbox opened":                              1,
+		"DEBUG mbox closed":                              1,
+		"DEBUG compression detected application/x-bzip2": 1,
+		"DEBUG boundary detector":                        1,
+		"DEBUG message boundary":                         1,
+		"DEBUG maildir opened":                           1,
+		"DEBUG maildir read":                             1,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("log mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// unlocked is an Operator counting messages without a lock, for use
+// with an OperatorFactory.
+type unlocked struct {
+	id, num int
+}
+
+func (u *unlocked) Operate(r io.Reader) error {
+	if _, err := mail.ReadMessage(r); err != nil {
+		return err
+	}
+	u.num++
+	return nil
+}
+
+func TestProcessFactory(t *testing.T) {
+	maildirs := []string{"maildir/testdata/example/"}
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/gonuts.mbox"}
+
+	for _, streaming := range []bool{false, true} {
+		var opts []Option
+		if streaming {
+			opts = append(opts, WithStreaming())
+		}
+		var ids []int
+		total := 0
+		factory := func(id int) Operator { return &unlocked{id: id} }
+		merge := func(ops []Operator) error {
+			for _, op := range ops {
+				u := op.(*unlocked)
+				ids = append(ids, u.id)
+				total += u.num
+			}
+			return nil
+		}
+		mo, err := NewMailboxOperatorWithFactory(mboxes, maildirs, factory, merge, oeh, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := total, 9; got != want {
+			t.Errorf("streaming %t: got %d want %d messages", streaming, got, want)
+		}
+		if len(ids) != WorkersNum || !slices.IsSorted(ids) {
+			t.Errorf("streaming %t: got operators %v for %d workers", streaming, ids, WorkersNum)
+		}
+	}
+
+	// factory and merge errors
+	if _, err := NewMailboxOperatorWithFactory(mboxes, nil, nil, nil, oeh); err == nil {
+		t.Error("expected error for nil factory")
+	}
+	mo, err := NewMailboxOperatorWithFactory(mboxes, nil, func(int) Operator { return nil }, nil, oeh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err == nil {
+		t.Error("expected error for nil operator from factory")
+	}
+	mergeErr := errors.New("merge failed")
+	mo, err = NewMailboxOperatorWithFactory(mboxes, nil,
+		func(id int) Operator { return &unlocked{id: id} },
+		func([]Operator) error { return mergeErr }, oeh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); !errors.Is(err, mergeErr) {
+		t.Errorf("got %v want merge error", err)
+	}
+
+	// merge is called when the run stops opening the mailboxes
+	merged := 0
+	mo, err = NewMailboxOperatorWithFactory([]string{"mbox/testdata/missing.mbox"}, nil,
+		func(id int) Operator { return &unlocked{id: id} },
+		func(ops []Operator) error {
+			merged = len(ops)
+			return nil
+		}, OpErrFatalHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var se *SourceError
+	if err := mo.Operate(); !errors.As(err, &se) || se.Phase != PhaseOpen {
+		t.Fatalf("expected open SourceError, got %v", err)
+	}
+	if merged != WorkersNum {
+		t.Errorf("got %d merged Operators want %d", merged, WorkersNum)
+	}
+}
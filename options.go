@@ -0,0 +1,258 @@
+package mailboxoperator
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/rorycl/mailboxoperator/maildir"
+	"github.com/rorycl/mailboxoperator/mbox"
+	"github.com/rorycl/mailboxoperator/mbox/parser"
+	"github.com/rorycl/mailboxoperator/uncompress"
+)
+
+// Option configures a MailboxOperator.
+type Option func(*MailboxOperator)
+
+// WithBoundaryDetector sets the parser.BoundaryDetector used to find
+// the boundaries between messages in mbox files. The default is
+// parser.LenientDetector.
+func WithBoundaryDetector(d parser.BoundaryDetector) Option {
+	return func(m *MailboxOperator) {
+		m.mboxOpts = append(m.mboxOpts, mbox.WithDetector(d))
+	}
+}
+
+// WithHeadersOnly sets the MailboxOperator to pass only the header
+// block of each message to the Operator, ending at the first empty
+// line. Message bodies are skipped without being buffered, which
+// speeds up operations such as indexing or sender statistics.
+func WithHeadersOnly() Option {
+	return func(m *MailboxOperator) {
+		m.mboxOpts = append(m.mboxOpts, mbox.WithHeadersOnly())
+		m.maildirOpts = append(m.maildirOpts, maildir.WithHeadersOnly())
+	}
+}
+
+// WithStreaming sets the MailboxOperator to pass each message to the
+// Operator as a reader drawing directly on its source, rather than
+// first buffering the whole message in memory. Each source waits for
+// the Operator to finish with a message before reading the next, so
+// at most one message per source is in flight. The reader is only
+// valid for the duration of the call to Operate.
+func WithStreaming() Option {
+	return func(m *MailboxOperator) {
+		m.streaming = true
+		m.mboxOpts = append(m.mboxOpts, mbox.WithStreaming())
+	}
+}
+
+// WithMemoryBudget limits the bytes of messages handed from the mailbox
+// producers to the workers to max bytes. Once a producer has read a
+// message it blocks while the budget is exhausted, until workers have
+// finished with earlier messages. The message is only counted against
+// the budget once read, so peak memory use is bounded by the budget
+// plus the message being read from each mailbox: once for a maildir,
+// and twice for an mbox, whose parser holds the message while it is
+// copied into the buffer handed to the workers. A message larger than
+// the budget is processed on its own. The budget does not apply in
+// streaming mode, in which at most one message per mailbox is in
+// flight.
+func WithMemoryBudget(max int64) Option {
+	return func(m *MailboxOperator) {
+		m.budget = newBudget(max)
+	}
+}
+
+// SizePolicy determines the treatment of messages larger than the
+// maximum message size set by WithMaxMessageSize.
+type SizePolicy int
+
+const (
+	// SkipLargeMessages drops messages over the maximum size.
+	SkipLargeMessages SizePolicy = iota
+	// TruncateLargeMessages passes the first maximum size bytes of
+	// messages over the maximum size to the Operator.
+	TruncateLargeMessages
+	// ReportLargeMessages drops messages over the maximum size, passing
+	// an OperationError wrapping ErrMessageTooLarge to the
+	// OperatorErrorHandler.
+	ReportLargeMessages
+)
+
+// WithMaxMessageSize limits messages to max bytes, treating larger
+// messages according to policy. Reading stops at the limit, so no more
+// than max bytes of a message are held in memory. This guards against
+// corrupt mboxes without separators becoming a single vast message.
+//
+// In streaming mode messages cannot be skipped before they are passed
+// to the Operator, so reads beyond the limit return io.EOF with
+// TruncateLargeMessages and ErrMessageTooLarge otherwise.
+func WithMaxMessageSize(max int64, policy SizePolicy) Option {
+	return func(m *MailboxOperator) {
+		m.maxSize = max
+		m.sizePolicy = policy
+		m.mboxOpts = append(m.mboxOpts, mbox.WithMaxMessageSize(max))
+		m.maildirOpts = append(m.maildirOpts, maildir.WithMaxMessageSize(max))
+	}
+}
+
+// WithDecompressionLimits protects against decompression bombs in
+// compressed mboxes by limiting the total uncompressed bytes of each
+// mbox, the ratio of uncompressed to compressed bytes and the xz
+// dictionary size. A zero value sets no limit. Exceeding a limit stops
+// processing with an error wrapping an *uncompress.LimitError.
+func WithDecompressionLimits(maxBytes, maxRatio, maxDictSize int64) Option {
+	return func(m *MailboxOperator) {
+		m.mboxOpts = append(m.mboxOpts, mbox.WithUncompressOptions(
+			uncompress.WithMaxBytes(maxBytes),
+			uncompress.WithMaxRatio(maxRatio),
+			uncompress.WithMaxDictSize(maxDictSize),
+		))
+	}
+}
+
+// WithParallelDecompression decompresses up to n independently
+// compressed segments of each compressed mbox concurrently: the blocks
+// of bzip2 files, the blocks of multi-block xz files and the members of
+// multi-member gzip files. Messages are still read in order. Up to n
+// segments of each mbox, of up to 16MiB of output each, are held in
+// memory.
+func WithParallelDecompression(n int) Option {
+	return func(m *MailboxOperator) {
+		m.mboxOpts = append(m.mboxOpts, mbox.WithUncompressOptions(
+			uncompress.WithParallel(n),
+		))
+	}
+}
+
+// WithSalvage continues processing after an error reading an mbox part
+// way through, such as a CRC error or the unexpected end of a damaged
+// compressed mbox, rather than stopping with an error. The complete
+// messages read before the error are processed. The partial message
+// being read is not processed but reported as an *OperationError
+// wrapping a *ReadError giving its byte position, and processing
+// continues with the other mailboxes. In streaming mode the partial
+// message has already been passed to the Operator, whose reads return
+// the error.
+func WithSalvage() Option {
+	return func(m *MailboxOperator) {
+		m.salvage = true
+	}
+}
+
+// WithQuarantine adds each message for which the Operator returns an
+// error to q, such as an mbox.MboxWriter or maildir.MailDirWriter, for
+// review. X-MailboxOperator-Error, X-MailboxOperator-Source and
+// X-MailboxOperator-Offset headers are added to the message recording
+// the error, the mailbox kind and path, and the message offset. An
+// error adding a message is reported as an OperationError. The caller
+// should close q after Operate returns. Messages cannot be quarantined
+// in streaming mode, as they are not buffered, and in headers only
+// mode only the headers are quarantined.
+func WithQuarantine(q Quarantine) Option {
+	return func(m *MailboxOperator) {
+		m.quarantine = q
+	}
+}
+
+// WithOperateTimeout limits each call to the Operator to d. A call
+// which has not returned within d is abandoned and reported as an
+// OperationError wrapping ErrOperateTimeout, and the worker moves on to
+// the next message. Go cannot stop the abandoned call, which continues
+// in the background, but its further reads of the message fail and its
+// result is discarded. A ContextOperator is passed a context with the
+// deadline, which is cancelled on timeout, and should return promptly
+// once it is done.
+func WithOperateTimeout(d time.Duration) Option {
+	return func(m *MailboxOperator) {
+		m.timeout = d
+	}
+}
+
+// WithProgress calls f with the Progress of each mailbox as messages
+// are processed, at most once per interval for each mailbox, and once
+// all its messages have been processed. Progress is measured in
+// messages and in bytes read against the size of the mailbox, using the
+// position in the compressed file for compressed mboxes.
+func WithProgress(f ProgressFunc, interval time.Duration) Option {
+	return func(m *MailboxOperator) {
+		m.progress = f
+		m.progressInterval = interval
+	}
+}
+
+// WithProgressPreScan counts the messages of each mailbox before
+// processing, so that Progress reports exact message totals. Mboxes
+// are read an extra time to count their messages.
+func WithProgressPreScan() Option {
+	return func(m *MailboxOperator) {
+		m.preScan = true
+	}
+}
+
+// WithLogger sets the logger recording the opening and reading of each
+// mailbox at info level, errors and the decisions of the
+// OperatorErrorHandler at warn and error level, and, at debug level,
+// the compression detected, the boundary detector used and the message
+// boundaries found or candidate postmark lines rejected in mboxes. By
+// default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(m *MailboxOperator) {
+		if l == nil {
+			return
+		}
+		m.logger = l
+		m.mboxOpts = append(m.mboxOpts, mbox.WithLogger(l))
+		m.maildirOpts = append(m.maildirOpts, maildir.WithLogger(l))
+	}
+}
+
+// WithMetrics publishes counters of messages, bytes and errors,
+// histograms of Operator latency and message size, and gauges of busy
+// workers, waiting producers and active mailboxes to mt, such as an
+// ExpvarMetrics. See MetricDescs.
+func WithMetrics(mt Metrics) Option {
+	return func(m *MailboxOperator) {
+		if mt != nil {
+			m.metrics = mt
+		}
+	}
+}
+
+// WithTracer starts spans with t around the run, the reading of each
+// mailbox and each message, attributing time to reading and
+// decompressing, parsing, buffering, waiting for a worker and the
+// Operator. A ContextOperator is passed a context carrying the operate
+// span, as the parent of any spans it starts. See SpanRun.
+func WithTracer(t Tracer) Option {
+	return func(m *MailboxOperator) {
+		if t != nil {
+			m.tracer = t
+		}
+	}
+}
+
+// WithBatchSize sets the maximum size of the batches of messages passed
+// to a BatchOperator, and the maximum time the first message of a
+// batch waits for it to fill before the batch is passed on. The
+// defaults are 100 messages and one second.
+func WithBatchSize(size int, maxLatency time.Duration) Option {
+	return func(m *MailboxOperator) {
+		if size > 0 {
+			m.batchSize = size
+		}
+		if maxLatency > 0 {
+			m.batchLatency = maxLatency
+		}
+	}
+}
+
+// WithSourceHooks calls the SourceStart and SourceEnd hooks of s as
+// each mailbox is started and finished, in place of those of the
+// Operator, if any. s is not passed messages. This is the only way to
+// set the hooks of a MailboxOperator made with an OperatorFactory.
+func WithSourceHooks(s SourceOperator) Option {
+	return func(m *MailboxOperator) {
+		m.sourceHooks = s
+	}
+}
@@ -0,0 +1,140 @@
+package mailboxoperator
+
+// progress provides progress reporting of the processing of each
+// mailbox, for progress bars and estimates of the time remaining.
+
+import (
+	"os"
+	"time"
+
+	"github.com/rorycl/mailboxoperator/maildir"
+	"github.com/rorycl/mailboxoperator/mbox"
+	"golang.org/x/sync/errgroup"
+)
+
+// Progress reports the progress of processing a mailbox.
+type Progress struct {
+	Kind          string        // mbox or maildir
+	Path          string        // path to mbox or maildir
+	Messages      int           // messages processed
+	TotalMessages int           // total messages, if pre-scanned, otherwise zero
+	Bytes         int64         // bytes read from disk, compressed for compressed mboxes
+	TotalBytes    int64         // size of the mbox file or of the maildir files
+	Elapsed       time.Duration // time since the mailbox started being read
+	Done          bool          // all messages have been processed
+}
+
+// Fraction returns the fraction of the mailbox processed, by messages
+// if the total is known, otherwise by bytes.
+func (p Progress) Fraction() float64 {
+	switch {
+	case p.Done:
+		return 1
+	case p.TotalMessages > 0:
+		return min(float64(p.Messages)/float64(p.TotalMessages), 1)
+	case p.TotalBytes > 0:
+		return min(float64(p.Bytes)/float64(p.TotalBytes), 1)
+	}
+	return 0
+}
+
+// ETA returns the estimated time remaining to process the mailbox at
+// the rate so far, or zero if no progress has been made.
+func (p Progress) ETA() time.Duration {
+	f := p.Fraction()
+	if f <= 0 || f >= 1 {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * (1 - f) / f)
+}
+
+// ProgressFunc receives the Progress of each mailbox. Calls are
+// serialised, and should return promptly, since processing waits for
+// them.
+type ProgressFunc func(Progress)
+
+// progressState tracks the progress of a mailbox for a ProgressFunc.
+type progressState struct {
+	start         time.Time
+	last          time.Time // time of the last call to the ProgressFunc
+	bytes         int64
+	totalBytes    int64
+	totalMessages int
+	sizes         map[string]int64 // maildir file sizes by path
+	produced      bool             // all messages have been read
+	done          bool
+}
+
+// progressTotals returns the progressStates of sources with the total
+// bytes of each and, if pre-scanning, the total messages.
+func (m *MailboxOperator) progressTotals(sources []source) []progressState {
+	states := make([]progressState, len(sources))
+	g := new(errgroup.Group)
+	for i, s := range sources {
+		g.Go(func() error {
+			ps := &states[i]
+			switch md := s.mail.(type) {
+			case *maildir.MailDir:
+				ps.sizes = map[string]int64{}
+				for _, mf := range md.Contents {
+					if fi, err := os.Stat(mf.Path); err == nil {
+						ps.sizes[mf.Path] = fi.Size()
+						ps.totalBytes += fi.Size()
+					}
+				}
+				if m.preScan {
+					ps.totalMessages = md.TotalEmails()
+				}
+			default:
+				if fi, err := os.Stat(s.path); err == nil {
+					ps.totalBytes = fi.Size()
+				}
+				if m.preScan {
+					ps.totalMessages, _ = mbox.CountMessages(s.path, m.mboxOpts...)
+				}
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return states
+}
+
+// begin records the start of reading source i.
+func (r *runStats) begin(i int) {
+	r.Lock()
+	defer r.Unlock()
+	if r.progress != nil {
+		r.states[i].start = time.Now()
+	}
+}
+
+// notify calls the ProgressFunc with the progress of source i, at most once per
+// interval unless the source is done. It is called with r locked.
+func (r *runStats) notify(i int) {
+	if r.progress == nil {
+		return
+	}
+	ps := &r.states[i]
+	sr := r.sources[i]
+	if ps.done {
+		return
+	}
+	processed := sr.Operated + sr.Skipped
+	ps.done = ps.produced && processed >= sr.Read
+	now := time.Now()
+	if !ps.done && now.Sub(ps.last) < r.interval {
+		return
+	}
+	ps.last = now
+	r.progress(Progress{
+		Kind:          sr.Kind,
+		Path:          sr.Path,
+		Messages:      processed,
+		TotalMessages: ps.totalMessages,
+		Bytes:         ps.bytes,
+		TotalBytes:    ps.totalBytes,
+		Elapsed:       now.Sub(ps.start),
+		Done:          ps.done,
+	})
+}
@@ -0,0 +1,99 @@
+package mailboxoperator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	mboxes := []string{"mbox/testdata/golang.mbox.bz2"}
+	maildirs := []string{"maildir/testdata/example/"}
+
+	for _, preScan := range []bool{false, true} {
+		var updates []Progress
+		opts := []Option{WithProgress(func(p Progress) {
+			updates = append(updates, p)
+		}, 0)}
+		if preScan {
+			opts = append(opts, WithProgressPreScan())
+		}
+		c := &counter{}
+		mo, err := NewMailboxOperator(mboxes, maildirs, c, oeh, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatal(err)
+		}
+
+		final := map[string]Progress{}
+		last := map[string]Progress{}
+		for _, p := range updates {
+			if prev, ok := last[p.Path]; ok {
+				if prev.Done {
+					t.Errorf("prescan %t: %s update after done", preScan, p.Path)
+				}
+				if p.Messages < prev.Messages || p.Bytes < prev.Bytes {
+					t.Errorf("prescan %t: %s progress went backwards %+v %+v", preScan, p.Path, prev, p)
+				}
+			}
+			last[p.Path] = p
+			if p.Done {
+				final[p.Path] = p
+			}
+		}
+
+		want := map[string][2]int64{ // messages, bytes
+			mboxes[0]:   {2, fileSizes(t, mboxes[0])},
+			maildirs[0]: {6, fileSizes(t, "maildir/testdata/example/*/*")},
+		}
+		for path, w := range want {
+			p, ok := final[path]
+			if !ok {
+				t.Fatalf("prescan %t: %s not done", preScan, path)
+			}
+			if int64(p.Messages) != w[0] || p.Bytes != w[1] || p.TotalBytes != w[1] {
+				t.Errorf("prescan %t: %s unexpected final progress %+v", preScan, path, p)
+			}
+			wantTotal := 0
+			if preScan {
+				wantTotal = int(w[0])
+			}
+			if p.TotalMessages != wantTotal {
+				t.Errorf("prescan %t: %s got total %d want %d", preScan, path, p.TotalMessages, wantTotal)
+			}
+			if p.Fraction() != 1 || p.ETA() != 0 {
+				t.Errorf("prescan %t: %s unexpected fraction %f eta %s", preScan, path, p.Fraction(), p.ETA())
+			}
+		}
+	}
+
+	// updates are limited to one per interval, besides the last
+	var n int
+	mo, err := NewMailboxOperator(nil, maildirs, &counter{}, oeh, WithProgress(func(p Progress) {
+		n++
+	}, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d want 2 updates", n)
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	p := Progress{Messages: 25, TotalMessages: 100, Bytes: 10, TotalBytes: 1000, Elapsed: time.Minute}
+	if got, want := p.Fraction(), 0.25; got != want {
+		t.Errorf("fraction got %f want %f", got, want)
+	}
+	if got, want := p.ETA(), 3*time.Minute; got != want {
+		t.Errorf("eta got %s want %s", got, want)
+	}
+	p.TotalMessages = 0
+	if got, want := p.Fraction(), 0.01; got != want {
+		t.Errorf("fraction by bytes got %f want %f", got, want)
+	}
+}
@@ -0,0 +1,65 @@
+package mailboxoperator
+
+// quarantine provides for writing messages for which the Operator
+// returned an error to a mailbox for review.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// Quarantine receives messages for which the Operator returned an
+// error. mbox.MboxWriter and maildir.MailDirWriter are Quarantines.
+type Quarantine interface {
+	Add(from string, date time.Time, messageId string, r io.Reader) (bool, error)
+}
+
+// quarantineFrom is the mbox From line sender for messages without a
+// parseable From header.
+const quarantineFrom = "MAILER-DAEMON"
+
+// quarantine adds the message data from mf, for which the Operator
+// returned opErr, to the Quarantine q. The message is prefixed with
+// X-MailboxOperator-Error, X-MailboxOperator-Source and
+// X-MailboxOperator-Offset headers recording the error and the source
+// of the message.
+func quarantine(q Quarantine, mf *mailfile.MailFile, data []byte, opErr error) error {
+	// drop any mbox From line, which the mbox writer replaces
+	if bytes.HasPrefix(data, []byte("From ")) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+
+	from, date := quarantineFrom, time.Now()
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil && addr.Address != "" {
+			from = addr.Address
+		}
+		if d, err := msg.Header.Date(); err == nil {
+			date = d
+		}
+	}
+
+	headers := fmt.Sprintf(
+		"X-MailboxOperator-Error: %s\nX-MailboxOperator-Source: %s %s\nX-MailboxOperator-Offset: %d\n",
+		headerValue(opErr.Error()), mf.Kind, headerValue(mf.Path), mf.No,
+	)
+	id := fmt.Sprintf("%s:%s:%d", mf.Kind, mf.Path, mf.No)
+	_, err := q.Add(from, date, id, io.MultiReader(strings.NewReader(headers), bytes.NewReader(data)))
+	if err != nil {
+		return fmt.Errorf("quarantine error: %w", err)
+	}
+	return nil
+}
+
+// headerValue replaces line breaks in s for use as a header value.
+func headerValue(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,135 @@
+package mailboxoperator
+
+import (
+	"errors"
+	"io"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rorycl/mailboxoperator/maildir"
+	"github.com/rorycl/mailboxoperator/mbox"
+)
+
+// failing is an Operator which always fails, with a multiline error.
+type failing struct{}
+
+func (failing) Operate(r io.Reader) error {
+	_, _ = io.Copy(io.Discard, r)
+	return errors.New("operation\nfailed")
+}
+
+// readQuarantined reads the headers of the messages in mailbox.
+func readQuarantined(t *testing.T, mailbox readNextMail) []mail.Header {
+	t.Helper()
+	var headers []mail.Header
+	for {
+		_, r, err := mailbox.NextReader()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := mail.ReadMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, msg.Header)
+		if c, ok := r.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+	return headers
+}
+
+func TestProcessQuarantine(t *testing.T) {
+	dir := t.TempDir()
+
+	// mbox quarantine
+	path := filepath.Join(dir, "quarantine.mbox")
+	mq, err := mbox.NewMboxWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mo, err := NewMailboxOperator([]string{"mbox/testdata/gonuts.mbox"}, nil, failing{}, OpErrPrintHandler, WithQuarantine(mq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mb, err := mbox.NewMbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := readQuarantined(t, mb)
+	if got, want := len(headers), 1; got != want {
+		t.Fatalf("got %d want %d quarantined mbox messages", got, want)
+	}
+	h := headers[0]
+	for k, want := range map[string]string{
+		"X-MailboxOperator-Error":  "operation failed",
+		"X-MailboxOperator-Source": "mbox mbox/testdata/gonuts.mbox",
+		"X-MailboxOperator-Offset": "0",
+	} {
+		if got := h.Get(k); got != want {
+			t.Errorf("%s: got %q want %q", k, got, want)
+		}
+	}
+	if h.Get("From") == "" || h.Get("Message-Id") == "" {
+		t.Error("original headers not quarantined")
+	}
+
+	// maildir quarantine of the message failing with simple
+	var s simple
+	path = filepath.Join(dir, "quarantine")
+	dq, err := maildir.NewMailDirWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mo, err = NewMailboxOperator(nil, []string{"maildir/testdata/example/"}, &s, OpErrPrintHandler, WithQuarantine(dq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	md, err := maildir.NewMailDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers = readQuarantined(t, md)
+	if got, want := len(headers), 1; got != want {
+		t.Fatalf("got %d want %d quarantined maildir messages", got, want)
+	}
+	h = headers[0]
+	if got := h.Get("X-MailboxOperator-Error"); !strings.Contains(got, "koi8-r") {
+		t.Errorf("unexpected error header %q", got)
+	}
+	if got, want := h.Get("X-MailboxOperator-Source"), "maildir maildir/testdata/example/cur/1735238277.2023287_9.example_2_s"; got != want {
+		t.Errorf("got source %q want %q", got, want)
+	}
+
+	// messages are not quarantined in streaming mode
+	path = filepath.Join(dir, "streaming.mbox")
+	sq, err := mbox.NewMboxWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mo, err = NewMailboxOperator([]string{"mbox/testdata/gonuts.mbox"}, nil, failing{}, OpErrPrintHandler, WithQuarantine(sq), WithStreaming())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	_ = sq.Close()
+	if _, err := mbox.NewMbox(path); !errors.Is(err, io.EOF) {
+		t.Errorf("expected empty streaming quarantine, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package mailboxoperator
+
+// report provides a summary of the messages and bytes read and
+// processed by a run of OperateReport.
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// RunCounts are the counts of messages and bytes processed, for a
+// mailbox or a whole run.
+type RunCounts struct {
+	Read      int           // messages read
+	Operated  int           // messages passed to the Operator
+	Errors    int           // errors returned by the Operator
+	Skipped   int           // messages read but not passed to the Operator
+	Bytes     int64         // uncompressed bytes read
+	FileBytes int64         // bytes read from disk, compressed for compressed mboxes
+	Duration  time.Duration // time taken to read the mailbox, or for the run
+}
+
+// MessagesPerSecond returns the messages read per second.
+func (c RunCounts) MessagesPerSecond() float64 {
+	if c.Duration <= 0 {
+		return 0
+	}
+	return float64(c.Read) / c.Duration.Seconds()
+}
+
+// BytesPerSecond returns the uncompressed bytes read per second.
+func (c RunCounts) BytesPerSecond() float64 {
+	if c.Duration <= 0 {
+		return 0
+	}
+	return float64(c.Bytes) / c.Duration.Seconds()
+}
+
+// SourceReport reports the processing of a mailbox. The Duration is
+// the time from opening the mailbox to reading its last message.
+type SourceReport struct {
+	Kind string // mbox or maildir
+	Path string // path to mbox or maildir
+	RunCounts
+}
+
+// RunReport reports the processing of the mailboxes in a call to
+// OperateReport. The counts are the totals of those of the Sources,
+// and the Duration that of the whole run.
+type RunReport struct {
+	RunCounts
+	Sources []SourceReport // the mailboxes opened, mboxes then maildirs
+}
+
+// runStats gathers the SourceReports of a run from the producers and
+// workers.
+type runStats struct {
+	sync.Mutex
+	start    time.Time
+	sources  []SourceReport
+	progress ProgressFunc
+	interval time.Duration
+	states   []progressState // of each source, if progress is set
+	metrics  Metrics
+	busy     atomic.Int64   // workers running the Operator
+	waiting  atomic.Int64   // producers waiting to send a message
+	active   atomic.Int64   // sources being read
+	hooks    SourceOperator // called as each source is started and finished with, if set
+	ends     []sourceState
+	counters []*ThresholdHandler // counting the messages operated on
+}
+
+// newRunStats returns a runStats for sources.
+func newRunStats(start time.Time, sources []source) *runStats {
+	r := &runStats{start: start, metrics: noMetrics{}, ends: make([]sourceState, len(sources))}
+	for _, s := range sources {
+		r.sources = append(r.sources, SourceReport{Kind: s.kind, Path: s.path})
+	}
+	return r
+}
+
+// add updates the SourceReport of source i with f.
+func (r *runStats) add(i int, f func(*SourceReport)) {
+	r.Lock()
+	f(&r.sources[i])
+	r.notify(i)
+	r.unlockEnding(i)
+}
+
+// unlockEnding unlocks r, then calls SourceEnd if source i has just
+// been finished with.
+func (r *runStats) unlockEnding(i int) {
+	if !r.ending(i) {
+		r.Unlock()
+		return
+	}
+	sr, err := r.sources[i], r.ends[i].err
+	r.Unlock()
+	r.hooks.SourceEnd(sr.Path, sr.Operated, err)
+}
+
+// read records the message mf read from source i, s.
+func (r *runStats) read(i int, s source, mf *mailfile.MailFile) {
+	r.Lock()
+	defer r.Unlock()
+	r.sources[i].Read++
+	r.metrics.Add(MetricMessages, 1, s.kind)
+	if r.progress == nil {
+		return
+	}
+	ps := &r.states[i]
+	if b, ok := s.mail.(bytesReader); ok {
+		ps.bytes, _ = b.BytesRead()
+	} else {
+		ps.bytes += ps.sizes[mf.Path]
+	}
+	r.notify(i)
+}
+
+// finish records the end of reading source i, s, taking d with
+// msgBytes bytes of messages read, and the error stopping reading, if
+// any.
+func (r *runStats) finish(i int, s source, d time.Duration, msgBytes int64, err error) {
+	r.Lock()
+	defer r.unlockEnding(i)
+	r.ends[i] = sourceState{produced: true, err: err}
+	sr := &r.sources[i]
+	sr.Duration = d
+	sr.Bytes, sr.FileBytes = msgBytes, msgBytes
+	if b, ok := s.mail.(bytesReader); ok {
+		sr.FileBytes, sr.Bytes = b.BytesRead()
+	}
+	if r.progress == nil {
+		return
+	}
+	ps := &r.states[i]
+	if _, ok := s.mail.(bytesReader); ok {
+		ps.bytes = sr.FileBytes
+	}
+	ps.produced = true
+	r.notify(i)
+}
+
+// messageBytes records a message of n bytes from a mailbox of kind.
+func (r *runStats) messageBytes(kind string, n int64) {
+	r.metrics.Add(MetricBytes, float64(n), kind)
+	r.metrics.Observe(MetricMessageBytes, float64(n), kind)
+}
+
+// gauge adds delta to the gauge g, publishing it as the metric name.
+func (r *runStats) gauge(name string, g *atomic.Int64, delta int64) {
+	r.metrics.Set(name, float64(g.Add(delta)))
+}
+
+// send sends mbi to the workers over the reader chan, returning false
+// if processing is cancelled first.
+func (r *runStats) send(ctx context.Context, reader chan<- mailBytesId, mbi mailBytesId) bool {
+	r.gauge(MetricWaitingProducers, &r.waiting, 1)
+	defer r.gauge(MetricWaitingProducers, &r.waiting, -1)
+	select {
+	case reader <- mbi:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// report returns the RunReport of the run.
+func (r *runStats) report() *RunReport {
+	r.Lock()
+	defer r.Unlock()
+	rr := &RunReport{Sources: append([]SourceReport{}, r.sources...)}
+	for _, s := range r.sources {
+		rr.Read += s.Read
+		rr.Operated += s.Operated
+		rr.Errors += s.Errors
+		rr.Skipped += s.Skipped
+		rr.Bytes += s.Bytes
+		rr.FileBytes += s.FileBytes
+	}
+	rr.Duration = time.Since(r.start)
+	return rr
+}
+
+// bytesReader is implemented by sources reporting the bytes read from
+// disk, such as *mbox.Mbox.
+type bytesReader interface {
+	BytesRead() (file, uncompressed int64)
+}
+
+// countingReader counts the bytes of a streamed message.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader, counting the bytes read.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,93 @@
+package mailboxoperator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fileSizes returns the total size of the files matching patterns.
+func fileSizes(t *testing.T, patterns ...string) int64 {
+	t.Helper()
+	var n int64
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += fi.Size()
+		}
+	}
+	return n
+}
+
+func TestOperateReport(t *testing.T) {
+	mboxes := []string{"mbox/testdata/golang.mbox", "mbox/testdata/golang.mbox.bz2", "mbox/testdata/missing.mbox"}
+	maildirs := []string{"maildir/testdata/example/"}
+
+	mboxSize := fileSizes(t, "mbox/testdata/golang.mbox")
+	maildirSize := fileSizes(t, "maildir/testdata/example/*/*")
+	want := []SourceReport{
+		{Kind: "mbox", Path: mboxes[0], RunCounts: RunCounts{Read: 2, Operated: 2, Bytes: mboxSize, FileBytes: mboxSize}},
+		{Kind: "mbox", Path: mboxes[1], RunCounts: RunCounts{Read: 2, Operated: 2, Bytes: mboxSize, FileBytes: fileSizes(t, mboxes[1])}},
+		{Kind: "maildir", Path: maildirs[0], RunCounts: RunCounts{Read: 6, Operated: 6, Errors: 1, Bytes: maildirSize, FileBytes: maildirSize}},
+	}
+
+	for _, streaming := range []bool{false, true} {
+		var opts []Option
+		if streaming {
+			opts = append(opts, WithStreaming())
+		}
+		var s simple
+		mo, err := NewMailboxOperator(mboxes, maildirs, &s, OpErrPrintHandler, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := mo.OperateReport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(report.Sources), len(want); got != want {
+			t.Fatalf("streaming %t: got %d want %d sources", streaming, got, want)
+		}
+		for i, w := range want {
+			got := report.Sources[i]
+			if got.Duration <= 0 {
+				t.Errorf("streaming %t: source %d has no duration", streaming, i)
+			}
+			got.Duration = 0
+			if got != w {
+				t.Errorf("streaming %t: source %d\ngot  %+v\nwant %+v", streaming, i, got, w)
+			}
+		}
+		total := report.RunCounts
+		if total.Read != 10 || total.Operated != 10 || total.Errors != 1 || total.Skipped != 0 {
+			t.Errorf("streaming %t: unexpected totals %+v", streaming, total)
+		}
+		if total.Bytes != 2*mboxSize+maildirSize {
+			t.Errorf("streaming %t: got %d want %d bytes", streaming, total.Bytes, 2*mboxSize+maildirSize)
+		}
+		if total.MessagesPerSecond() <= 0 || total.BytesPerSecond() <= 0 {
+			t.Errorf("streaming %t: no throughput for %+v", streaming, total)
+		}
+	}
+
+	// messages over the maximum size are skipped
+	c := &counter{}
+	mo, err := NewMailboxOperator(nil, maildirs, c, OpErrPrintHandler, WithMaxMessageSize(1500, SkipLargeMessages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := mo.OperateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Read != 6 || report.Operated != 3 || report.Skipped != 3 || c.num != 3 {
+		t.Errorf("unexpected counts %+v for %d messages operated", report.RunCounts, c.num)
+	}
+}
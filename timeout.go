@@ -0,0 +1,84 @@
+package mailboxoperator
+
+// timeout provides a watchdog abandoning calls to the Operator which
+// run beyond the time set by WithOperateTimeout.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrOperateTimeout is wrapped by the OperationError reporting a call
+// to the Operator which did not return within the time set by
+// WithOperateTimeout.
+var ErrOperateTimeout error = errors.New("operate timeout")
+
+// operate runs op on mbi. If a timeout is set and op has not returned
+// within it, the call is abandoned, further reads of the message fail
+// and ErrOperateTimeout is returned.
+func (m *MailboxOperator) operate(ctx context.Context, op Operator, mbi mailBytesId) error {
+	if m.timeout <= 0 {
+		return call(ctx, op, mbi.m, mbi.reader())
+	}
+	g := &guardedReader{r: mbi.reader()}
+	return m.withTimeout(ctx, func(ctx context.Context) error {
+		return call(ctx, op, mbi.m, g)
+	}, g.abandon)
+}
+
+// withTimeout runs f with a context carrying the timeout. If f has not
+// returned within it, abandon is called and ErrOperateTimeout returned.
+func (m *MailboxOperator) withTimeout(ctx context.Context, f func(context.Context) error, abandon func()) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- f(ctx)
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		// stop the abandoned call reading the message, which may be
+		// reused, unless it has since returned
+		abandon()
+		select {
+		case err = <-result:
+		default:
+			err = ctx.Err()
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %w", ErrOperateTimeout, m.timeout, err)
+	}
+	return err
+}
+
+// guardedReader reads a message until abandoned, after which reads
+// return ErrOperateTimeout.
+type guardedReader struct {
+	mu        sync.Mutex
+	r         io.Reader
+	abandoned bool
+}
+
+// Read reads from the underlying reader unless abandoned.
+func (g *guardedReader) Read(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.abandoned {
+		return 0, ErrOperateTimeout
+	}
+	return g.r.Read(p)
+}
+
+// abandon stops further reads, waiting for any read in progress.
+func (g *guardedReader) abandon() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.abandoned = true
+}
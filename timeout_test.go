@@ -0,0 +1,111 @@
+package mailboxoperator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// hanger is an Operator which hangs on the koi8-r encoded message in
+// the example maildir until released, then reports the error from
+// reading the remainder of the message on abandoned.
+type hanger struct {
+	counter
+	release   chan struct{}
+	abandoned chan error
+}
+
+func (h *hanger) Operate(r io.Reader) error {
+	b := make([]byte, 512)
+	n, err := io.ReadFull(r, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if bytes.Contains(b[:n], []byte("koi8-r")) {
+		<-h.release
+		_, err := io.ReadAll(r)
+		h.abandoned <- err
+		return nil
+	}
+	return h.counter.Operate(io.MultiReader(bytes.NewReader(b[:n]), r))
+}
+
+// ctxHanger is a ContextOperator which waits for its context to be
+// done on the koi8-r encoded message in the example maildir.
+type ctxHanger struct {
+	counter
+	noDeadline bool
+}
+
+func (h *ctxHanger) OperateContext(ctx context.Context, r io.Reader) error {
+	if _, ok := ctx.Deadline(); !ok {
+		h.noDeadline = true
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("koi8-r")) {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return h.counter.Operate(bytes.NewReader(b))
+}
+
+func TestProcessOperateTimeout(t *testing.T) {
+	maildirs := []string{"maildir/testdata/example/"}
+
+	for _, streaming := range []bool{false, true} {
+		opts := []Option{WithOperateTimeout(50 * time.Millisecond)}
+		if streaming {
+			opts = append(opts, WithStreaming())
+		}
+
+		h := &hanger{release: make(chan struct{}), abandoned: make(chan error, 1)}
+		c := NewErrorCollector()
+		mo, err := NewMailboxOperator(nil, maildirs, h, c.Handle, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := h.num, 5; got != want {
+			t.Errorf("streaming %t: got %d want %d messages", streaming, got, want)
+		}
+		errs := c.Errors()
+		var oe *OperationError
+		if len(errs) != 1 || !errors.Is(errs[0], ErrOperateTimeout) || !errors.As(errs[0], &oe) || oe.Offset != 3 {
+			t.Fatalf("streaming %t: expected one timeout at offset 3, got %v", streaming, errs)
+		}
+
+		// the abandoned operation can no longer read the message
+		close(h.release)
+		if err := <-h.abandoned; !errors.Is(err, ErrOperateTimeout) {
+			t.Errorf("streaming %t: abandoned read got %v", streaming, err)
+		}
+	}
+
+	// a ContextOperator is passed the deadline
+	h := &ctxHanger{}
+	c := NewErrorCollector()
+	mo, err := NewMailboxOperator(nil, maildirs, h, c.Handle, WithOperateTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if h.noDeadline {
+		t.Error("context without deadline")
+	}
+	if got, want := h.num, 5; got != want {
+		t.Errorf("got %d want %d messages", got, want)
+	}
+	if errs := c.Errors(); len(errs) != 1 || !errors.Is(errs[0], ErrOperateTimeout) {
+		t.Errorf("expected one timeout, got %v", errs)
+	}
+}
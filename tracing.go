@@ -0,0 +1,100 @@
+package mailboxoperator
+
+// tracing provides optional spans around a run, each mailbox and each
+// message through the Tracer interface.
+
+import (
+	"context"
+	"time"
+
+	"github.com/rorycl/mailboxoperator/mailfile"
+)
+
+// Tracer starts Spans. Its shape follows the OpenTelemetry trace API,
+// so that an adapter need only convert Attributes to attribute.KeyValues
+// and wrap trace.Span. The context returned by Start carries the span
+// as the parent of spans started from it, and must retain the
+// cancellation of ctx. Implementations must be safe for concurrent use.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is an operation started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key and value describing a Span. Values are strings,
+// ints, int64s or float64s.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// The names of the spans started by a MailboxOperator. A run span is
+// the parent of a source span for each mailbox, which is the parent of
+// a read span for each call to read the next message, covering parsing
+// and decompression, and of a message span for each message read. A
+// message span covers the time from reading a message to the Operator
+// finishing with it, and is the parent of a buffer span, unless
+// streaming, and an operate span for the call to the Operator. Time in
+// a message span outside its children is spent waiting for a worker.
+// The operate span of a batch passed to a BatchOperator is a child of
+// the run span.
+const (
+	SpanRun     = "mailboxoperator.run"
+	SpanSource  = "mailboxoperator.source"
+	SpanRead    = "mailboxoperator.read"
+	SpanMessage = "mailboxoperator.message"
+	SpanBuffer  = "mailboxoperator.buffer"
+	SpanOperate = "mailboxoperator.operate"
+)
+
+// The keys of the span Attributes set by a MailboxOperator. The
+// AttrReadSeconds of a read span is the time spent reading and
+// decompressing an mbox file, the remainder of the span being spent
+// parsing it.
+const (
+	AttrMailboxes    = "mailbox.count"         // run: mailboxes to be opened
+	AttrKind         = "mailbox.kind"          // mbox or maildir
+	AttrPath         = "mailbox.path"          // path to mbox or maildir
+	AttrOffset       = "mailbox.offset"        // email offset in mbox or maildir
+	AttrReadSeconds  = "mailbox.read_seconds"  // read: time reading and decompressing
+	AttrMessageBytes = "mailbox.message_bytes" // buffer: message size
+	AttrBatchSize    = "mailbox.batch_size"    // operate: messages in a batch
+)
+
+// mailFileAttrs returns the Attributes describing mf.
+func mailFileAttrs(mf *mailfile.MailFile) []Attribute {
+	return []Attribute{{AttrKind, mf.Kind}, {AttrPath, mf.Path}, {AttrOffset, mf.No}}
+}
+
+// readTimer is implemented by sources reporting the time spent reading
+// and decompressing, such as *mbox.Mbox.
+type readTimer interface {
+	ReadTime() time.Duration
+}
+
+// readTime returns the time spent reading and decompressing source s.
+func (s source) readTime() time.Duration {
+	if t, ok := s.mail.(readTimer); ok {
+		return t.ReadTime()
+	}
+	return 0
+}
+
+// noTracer is the default Tracer, which records nothing.
+type noTracer struct{}
+
+func (noTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, noSpan{}
+}
+
+// noSpan is the Span started by noTracer.
+type noSpan struct{}
+
+func (noSpan) SetAttributes(...Attribute) {}
+func (noSpan) RecordError(error)          {}
+func (noSpan) End()                       {}
@@ -0,0 +1,184 @@
+package mailboxoperator
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+)
+
+// recordedSpan is a span recorded by recorder.
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]any
+	errs   []error
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) { s.errs = append(s.errs, err) }
+func (s *recordedSpan) End()                  { s.ended = true }
+
+// spanKey is the context key of a recordedSpan.
+type spanKey struct{}
+
+// recorder is a Tracer recording the spans started.
+type recorder struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recorder) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	r.Lock()
+	defer r.Unlock()
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, attrs: map[string]any{}}
+	s.SetAttributes(attrs...)
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// named returns the spans named name.
+func (r *recorder) named(name string) []*recordedSpan {
+	r.Lock()
+	defer r.Unlock()
+	spans := []*recordedSpan{}
+	for _, s := range r.spans {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// spanFinder is a ContextOperator recording the names of the spans in
+// the contexts it is passed.
+type spanFinder struct {
+	sync.Mutex
+	names map[string]int
+}
+
+func (f *spanFinder) Operate(r io.Reader) error {
+	return f.OperateContext(context.Background(), r)
+}
+
+func (f *spanFinder) OperateContext(ctx context.Context, r io.Reader) error {
+	f.Lock()
+	defer f.Unlock()
+	if s, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		f.names[s.name]++
+	}
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func TestTracer(t *testing.T) {
+	mboxes := []string{"mbox/testdata/golang.mbox.bz2"}
+	maildirs := []string{"maildir/testdata/example/"}
+
+	for _, streaming := range []bool{false, true} {
+		rec := &recorder{}
+		opts := []Option{WithTracer(rec)}
+		if streaming {
+			opts = append(opts, WithStreaming())
+		}
+		var s simple
+		mo, err := NewMailboxOperator(mboxes, maildirs, &s, NewErrorCollector().Handle, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mo.Operate(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s := range rec.spans {
+			if !s.ended {
+				t.Errorf("streaming %t: span %s %v not ended", streaming, s.name, s.attrs)
+			}
+		}
+		runs := rec.named(SpanRun)
+		if len(runs) != 1 || runs[0].parent != nil || runs[0].attrs[AttrMailboxes] != 2 {
+			t.Fatalf("streaming %t: unexpected run spans %v", streaming, runs)
+		}
+		sources := rec.named(SpanSource)
+		if len(sources) != 2 {
+			t.Fatalf("streaming %t: got %d want 2 source spans", streaming, len(sources))
+		}
+
+		// a read span for each message and the end of each mailbox
+		tests := []struct {
+			name   string
+			parent string
+			want   int
+		}{
+			{SpanSource, SpanRun, 2},
+			{SpanRead, SpanSource, 10},
+			{SpanMessage, SpanSource, 8},
+			{SpanOperate, SpanMessage, 8},
+		}
+		if !streaming {
+			tests = append(tests, struct {
+				name   string
+				parent string
+				want   int
+			}{SpanBuffer, SpanMessage, 8})
+		} else if got := len(rec.named(SpanBuffer)); got != 0 {
+			t.Errorf("streaming: got %d buffer spans", got)
+		}
+		for _, tt := range tests {
+			spans := rec.named(tt.name)
+			if len(spans) != tt.want {
+				t.Errorf("streaming %t: got %d want %d %s spans", streaming, len(spans), tt.want, tt.name)
+			}
+			for _, s := range spans {
+				if s.parent == nil || s.parent.name != tt.parent {
+					t.Errorf("streaming %t: %s span without %s parent", streaming, tt.name, tt.parent)
+				}
+			}
+		}
+
+		// the koi8-r message at maildir offset 3 fails
+		failed := 0
+		for _, s := range rec.named(SpanOperate) {
+			if len(s.errs) > 0 {
+				failed++
+				if s.attrs[AttrKind] != "maildir" || s.attrs[AttrOffset] != 3 {
+					t.Errorf("streaming %t: unexpected failed span %v", streaming, s.attrs)
+				}
+			}
+		}
+		if failed != 1 {
+			t.Errorf("streaming %t: got %d want 1 failed operate span", streaming, failed)
+		}
+
+		// mbox reads are timed
+		for _, s := range rec.named(SpanRead) {
+			if s.parent.attrs[AttrKind] != "mbox" {
+				continue
+			}
+			if _, ok := s.attrs[AttrReadSeconds].(float64); !ok {
+				t.Errorf("streaming %t: mbox read span without %s", streaming, AttrReadSeconds)
+			}
+		}
+	}
+
+	// a ContextOperator is passed the operate span
+	rec := &recorder{}
+	f := &spanFinder{names: map[string]int{}}
+	mo, err := NewMailboxOperator(mboxes, maildirs, f, oeh, WithTracer(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mo.Operate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.names[SpanOperate], 8; got != want || len(f.names) != 1 {
+		t.Errorf("got spans %v want %d %s", f.names, want, SpanOperate)
+	}
+}
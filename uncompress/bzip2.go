@@ -0,0 +1,149 @@
+package uncompress
+
+// bzip2 provides the blocks of bzip2 files as segments for parallel
+// decompression. Each bzip2 block starts with a 48 bit magic number and
+// is bit, rather than byte, aligned. A block is decoded by wrapping it
+// in a bzip2 stream of its own, in the manner of pbzip2 and lbzip2.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"io"
+	"slices"
+)
+
+const (
+	bzip2BlockMagic = 0x314159265359
+	bzip2FinalMagic = 0x177245385090
+	bzip2MagicMask  = 1<<48 - 1
+)
+
+// bzip2Segment is a bzip2 block, held as a range of bits.
+type bzip2Segment struct {
+	data       []byte
+	start, end int64   // bit offsets of the block in data
+	finals     []int64 // bit offsets of end of stream markers in data
+}
+
+// decode decodes the block by wrapping it in a bzip2 stream. The block
+// ends at an end of stream marker, if any, or the end of the segment.
+// The stream checksum of a single block stream is the block checksum.
+func (s *bzip2Segment) decode(l *segmentLimits) ([]byte, io.Reader, error) {
+	crc := bitsAt(s.data, s.start+48, 32)
+	var err error
+	for _, end := range append(s.finals, s.end) {
+		w := &bitWriter{buf: []byte("BZh9")}
+		w.writeBitRange(s.data, s.start, end)
+		w.writeBits(bzip2FinalMagic, 48)
+		w.writeBits(crc, 32)
+		var (
+			out  []byte
+			rest io.Reader
+		)
+		out, rest, err = l.read(bzip2.NewReader(bytes.NewReader(w.bytes())), s.size())
+		if err == nil || errors.Is(err, ErrLimitExceeded) {
+			return out, rest, err
+		}
+	}
+	return nil, nil, err
+}
+
+// merge joins s with the following segment.
+func (s *bzip2Segment) merge(next segment) (segment, bool) {
+	n, ok := next.(*bzip2Segment)
+	if !ok {
+		return nil, false
+	}
+	// the segments share the byte holding the boundary
+	cut := s.end / 8
+	shift := cut * 8
+	m := &bzip2Segment{
+		data:   append(bytes.Clone(s.data[:cut]), n.data...),
+		start:  s.start,
+		end:    n.end + shift,
+		finals: slices.Clone(s.finals),
+	}
+	for _, f := range n.finals {
+		m.finals = append(m.finals, f+shift)
+	}
+	return m, true
+}
+
+// size is the compressed size of the segment.
+func (s *bzip2Segment) size() int64 {
+	return (s.end - s.start) / 8
+}
+
+// bzip2Segments provides the blocks of the bzip2 data read from r,
+// which may hold several concatenated bzip2 streams.
+func bzip2Segments(r io.Reader) segmentFunc {
+	return func(yield func(segment) bool) error {
+		br := bufio.NewReader(r)
+		var (
+			data      []byte  // bytes from dataStart
+			dataStart int64   // byte offset of data
+			pos       int64   // bits read
+			reg       uint64  // the last 48 bits read
+			start     int64   = -1
+			finals    []int64 // end of stream markers in the current block
+		)
+
+		// emit yields the current block, ending at bit offset end.
+		emit := func(end int64) bool {
+			from := start/8 - dataStart
+			s := &bzip2Segment{
+				data:  bytes.Clone(data[from : (end+7)/8-dataStart]),
+				start: start % 8,
+				end:   end - (start/8)*8,
+			}
+			for _, f := range finals {
+				s.finals = append(s.finals, f-(start/8)*8)
+			}
+			return yield(s)
+		}
+
+		for {
+			b, err := br.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			data = append(data, b)
+			if start < 0 && len(data) > 8 {
+				// outside a block only the bytes which may hold a
+				// magic number are retained
+				drop := int64(len(data) - 8)
+				data = append(data[:0], data[drop:]...)
+				dataStart += drop
+			}
+			for i := 7; i >= 0; i-- {
+				reg = (reg<<1 | uint64(b>>i)&1) & bzip2MagicMask
+				pos++
+				switch reg {
+				case bzip2BlockMagic:
+					magic := pos - 48
+					if start >= 0 && !emit(magic) {
+						return nil
+					}
+					start, finals = magic, nil
+					// retain data from the byte holding the magic
+					drop := magic/8 - dataStart
+					data = append(data[:0], data[drop:]...)
+					dataStart += drop
+				case bzip2FinalMagic:
+					if start >= 0 {
+						finals = append(finals, pos-48)
+					}
+				}
+			}
+		}
+		if start >= 0 {
+			emit(pos)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,187 @@
+package uncompress
+
+// gzip provides the members of multi-member gzip files, such as those
+// written by bgzip or by concatenating gzip files, as segments for
+// parallel decompression. bgzip records the size of each member in its
+// header. Otherwise member boundaries are not recorded in gzip files,
+// so candidate boundaries are found by searching for gzip headers which
+// are then checked by decoding the start of the member.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// gzipCheckBytes is the number of uncompressed bytes decoded to check
+// a candidate member boundary.
+const gzipCheckBytes = 1024
+
+// gzipSegment is a range of a gzip file holding one or more members.
+type gzipSegment struct {
+	r          io.ReaderAt
+	start, end int64
+}
+
+// decode decodes the members in the segment.
+func (s *gzipSegment) decode(l *segmentLimits) ([]byte, io.Reader, error) {
+	gz, err := gzip.NewReader(io.NewSectionReader(s.r, s.start, s.end-s.start))
+	if err != nil {
+		return nil, nil, err
+	}
+	return l.read(gz, s.size())
+}
+
+// merge joins s with the following segment.
+func (s *gzipSegment) merge(next segment) (segment, bool) {
+	n, ok := next.(*gzipSegment)
+	if !ok || n.start != s.end {
+		return nil, false
+	}
+	return &gzipSegment{r: s.r, start: s.start, end: n.end}, true
+}
+
+// size is the compressed size of the segment.
+func (s *gzipSegment) size() int64 {
+	return s.end - s.start
+}
+
+// gzipSearchBytes is the number of bytes of a gzip file which are
+// searched for a second member when the file is opened. Files whose
+// first member is longer are decompressed sequentially, unless written
+// by bgzip.
+const gzipSearchBytes = 1 << 20
+
+// gzipMultiMember reports if the gzip file of size bytes held in r has
+// more than one member: a BGZF block shorter than the file, or a
+// second member within the first gzipSearchBytes.
+func gzipMultiMember(r io.ReaderAt, size int64) bool {
+	if n := bgzfBlockSize(r, 0); n > 0 {
+		return n < size
+	}
+	found := false
+	_ = gzipMembers(r, min(size, gzipSearchBytes), size, func(int64) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// gzipMembers yields the offsets of the members following the first
+// found in the first limit bytes of the gzip file of size bytes held
+// in r, until yield returns false.
+func gzipMembers(r io.ReaderAt, limit, size int64, yield func(int64) bool) error {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, limit))
+	var window [10]byte // a gzip header without optional fields
+	var pos int64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		copy(window[:], window[1:])
+		window[9] = b
+		pos++
+		start := pos - 10
+		if start <= 0 || !plausibleGzipHeader(window) {
+			continue
+		}
+		if gzipMemberAt(r, start, size) && !yield(start) {
+			return nil
+		}
+	}
+}
+
+// bgzfBlockSize returns the size of the BGZF block at offset in r,
+// recorded in the BC subfield of the gzip extra field by bgzip, or 0
+// if the member at offset is not a BGZF block.
+func bgzfBlockSize(r io.ReaderAt, offset int64) int64 {
+	var h [12]byte
+	if _, err := r.ReadAt(h[:], offset); err != nil {
+		return 0
+	}
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 0x08 || h[3]&0x04 == 0 {
+		return 0
+	}
+	extra := make([]byte, binary.LittleEndian.Uint16(h[10:]))
+	if _, err := r.ReadAt(extra, offset+12); err != nil {
+		return 0
+	}
+	for len(extra) >= 4 {
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+n {
+			return 0
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && n == 2 {
+			return int64(binary.LittleEndian.Uint16(extra[4:])) + 1
+		}
+		extra = extra[4+n:]
+	}
+	return 0
+}
+
+// plausibleGzipHeader reports if h looks like the start of a gzip
+// member: the magic number, deflate compression, no reserved flags, a
+// known extra flag and a known operating system.
+func plausibleGzipHeader(h [10]byte) bool {
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 0x08 || h[3]&0xe0 != 0 {
+		return false
+	}
+	if h[8] != 0 && h[8] != 2 && h[8] != 4 {
+		return false
+	}
+	return h[9] <= 13 || h[9] == 255
+}
+
+// gzipMemberAt reports if the start of a gzip member at offset in r
+// can be decoded.
+func gzipMemberAt(r io.ReaderAt, offset, size int64) bool {
+	gz, err := gzip.NewReader(io.NewSectionReader(r, offset, size-offset))
+	if err != nil {
+		return false
+	}
+	gz.Multistream(false)
+	_, err = io.CopyN(io.Discard, gz, gzipCheckBytes)
+	return err == nil || errors.Is(err, io.EOF)
+}
+
+// gzipSegments provides the members of the gzip file of size bytes
+// held in r. The members of BGZF files are found from their block
+// sizes, and those of other files by searching the file as the members
+// are decoded.
+func gzipSegments(r io.ReaderAt, size int64) segmentFunc {
+	return func(yield func(segment) bool) error {
+		var start int64
+		if bgzfBlockSize(r, 0) > 0 {
+			for start < size {
+				n := bgzfBlockSize(r, start)
+				if n <= 0 {
+					// not a BGZF block, so decode the rest as one
+					n = size - start
+				}
+				end := min(start+n, size)
+				if !yield(&gzipSegment{r: r, start: start, end: end}) {
+					return nil
+				}
+				start = end
+			}
+			return nil
+		}
+		stopped := false
+		err := gzipMembers(r, size, size, func(end int64) bool {
+			stopped = !yield(&gzipSegment{r: r, start: start, end: end})
+			start = end
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+		yield(&gzipSegment{r: r, start: start, end: size})
+		return nil
+	}
+}
@@ -0,0 +1,492 @@
+package uncompress
+
+// index provides random access to the uncompressed contents of
+// compressed files. gzip files are indexed with checkpoints at the
+// start of deflate blocks, each recording the preceding 32KiB of
+// uncompressed data from which decompression can resume, after zlib's
+// zran.c. xz files are indexed by the block index at the end of each xz
+// stream.
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/ulikunitz/xz"
+)
+
+// DefaultIndexSpan is the default spacing of gzip index checkpoints in
+// uncompressed bytes.
+const DefaultIndexSpan = 1 << 20
+
+// indexVersion is the version of the encoding of an Index.
+const indexVersion = 1
+
+// ErrIndexIncomplete reports an Index requested from an IndexReader
+// which has not been read to the end.
+var ErrIndexIncomplete error = errors.New("index incomplete")
+
+// gzipCheckpoint is a point in a gzip file from which decompression can
+// resume.
+type gzipCheckpoint struct {
+	In     int64  // bit offset of a member or deflate block
+	Out    int64  // offset in the uncompressed data
+	Member bool   // In is the start of a gzip member
+	End    int64  // file offset of the end of the member
+	Window []byte // uncompressed data preceding a deflate block
+}
+
+// Index provides random access to the uncompressed contents of a file.
+// gzip and xz files are decompressed from a point near the requested
+// offset, bzip2 files from the start and uncompressed files are read
+// directly.
+type Index struct {
+	mime        string
+	size        int64 // uncompressed size
+	fileSize    int64 // size of the file
+	checkpoints []gzipCheckpoint
+}
+
+// Size returns the uncompressed size of the indexed file.
+func (x *Index) Size() int64 {
+	return x.size
+}
+
+// FileSize returns the size of the indexed file, which may be compared
+// with the file to check that the index is current.
+func (x *Index) FileSize() int64 {
+	return x.fileSize
+}
+
+// Reader returns an io.Reader providing the uncompressed contents of
+// the indexed file held in f from the uncompressed offset off. Data
+// read from a point within a gzip member is not checked against the
+// member checksum.
+func (x *Index) Reader(f io.ReaderAt, off int64) (io.Reader, error) {
+	if off < 0 || off > x.size {
+		return nil, fmt.Errorf("offset %d out of range", off)
+	}
+	var (
+		r    io.Reader
+		skip int64 // uncompressed bytes to discard
+		err  error
+	)
+	switch x.mime {
+	case "application/gzip":
+		r, skip, err = x.gzipReader(f, off)
+	case "application/x-xz":
+		r, skip, err = xzReader(f, x.fileSize, off)
+	case "application/x-bzip2":
+		r, skip = bzip2.NewReader(io.NewSectionReader(f, 0, x.fileSize)), off
+	default:
+		r = io.NewSectionReader(f, off, x.size-off)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// gzipReader returns a reader from the last checkpoint at or before
+// off, and the bytes to discard to reach off.
+func (x *Index) gzipReader(f io.ReaderAt, off int64) (io.Reader, int64, error) {
+	i, found := slices.BinarySearchFunc(x.checkpoints, off, func(c gzipCheckpoint, off int64) int {
+		switch {
+		case c.Out < off:
+			return -1
+		case c.Out > off:
+			return 1
+		}
+		return 0
+	})
+	if !found {
+		i--
+	}
+	if i < 0 {
+		return nil, 0, errors.New("gzip index has no checkpoints")
+	}
+	c := x.checkpoints[i]
+	members := func(start int64) (io.Reader, error) {
+		return gzip.NewReader(io.NewSectionReader(f, start, x.fileSize-start))
+	}
+	if c.Member {
+		r, err := members(c.In / 8)
+		return r, off - c.Out, err
+	}
+	blocks, err := alignDeflate(io.NewSectionReader(f, c.In/8, c.End-c.In/8), uint(c.In%8))
+	if err != nil {
+		return nil, 0, err
+	}
+	r := flate.NewReaderDict(blocks, c.Window)
+	if c.End < x.fileSize {
+		next, err := members(c.End)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.MultiReader(r, next), off - c.Out, nil
+	}
+	return r, off - c.Out, nil
+}
+
+// xzReader returns a reader from the xz block holding off, and the
+// bytes to discard to reach off. The blocks from that block onwards are
+// read as single block xz streams.
+func xzReader(f io.ReaderAt, size, off int64) (io.Reader, int64, error) {
+	idx, err := readXZIndex(f, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	i, _ := slices.BinarySearchFunc(idx.blocks, off, func(b xzBlock, off int64) int {
+		switch {
+		case b.uncompressedOffset+b.uncompressedSize <= off:
+			return -1
+		case b.uncompressedOffset > off:
+			return 1
+		}
+		return 0
+	})
+	if i == len(idx.blocks) {
+		return bytes.NewReader(nil), 0, nil
+	}
+	var streams []io.Reader
+	for _, b := range idx.blocks[i:] {
+		streams = append(streams,
+			bytes.NewReader(xzStreamHeader(b)),
+			io.NewSectionReader(f, b.offset, b.size),
+			bytes.NewReader(xzStreamTrailer(b)),
+		)
+	}
+	r, err := xz.NewReader(io.MultiReader(streams...))
+	return r, off - idx.blocks[i].uncompressedOffset, err
+}
+
+// alignDeflate returns the deflate data read from r, which starts at
+// bit shift of the first byte of r, as data starting at a byte
+// boundary. The bits preceding the deflate data are replaced with empty
+// deflate blocks, rather than the data being shifted, as stored blocks
+// are aligned to the bytes of the original data.
+func alignDeflate(r io.Reader, shift uint) (io.Reader, error) {
+	if shift == 0 {
+		return r, nil
+	}
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, err
+	}
+	prefix := emptyDeflateBlocks(shift)
+	prefix[len(prefix)-1] |= first[0] &^ (1<<shift - 1)
+	return io.MultiReader(bytes.NewReader(prefix), r), nil
+}
+
+// emptyDeflateBlocks returns empty deflate blocks occupying a multiple
+// of eight bits plus shift bits, shift being from one to seven. An
+// empty fixed huffman block occupies ten bits. An empty dynamic huffman
+// block, with an end of block code of one bit and code length codes
+// for 18, 1 and 0, occupies 95 bits.
+func emptyDeflateBlocks(shift uint) []byte {
+	var w lsbWriter
+	fixed := shift / 2
+	if shift%2 == 1 {
+		fixed = (shift + 1) % 8 / 2
+		w.write(0b100, 3) // not final, dynamic
+		w.write(0, 5)     // 257 literal/length codes
+		w.write(0, 5)     // 1 distance code
+		w.write(15, 4)    // 19 code length codes
+		for _, sym := range codeLengthOrder {
+			switch sym {
+			case 18:
+				w.write(1, 3)
+			case 0, 1:
+				w.write(2, 3)
+			default:
+				w.write(0, 3)
+			}
+		}
+		// code length codes are 18: 0, 0: 10 and 1: 11
+		w.write(0, 1)    // 18 with 138 zero lengths
+		w.write(127, 7)  // as 138-11
+		w.write(0, 1)    // 18 with 118 zero lengths
+		w.write(107, 7)  // as 118-11
+		w.write(0b11, 2) // end of block length 1
+		w.write(0b01, 2) // distance length 0
+		w.write(0, 1)    // end of block
+	}
+	for range fixed {
+		w.write(0b010, 3) // not final, fixed
+		w.write(0, 7)     // end of block
+	}
+	return w.bytes()
+}
+
+// lsbWriter writes bits least significant bit first, as deflate data.
+type lsbWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// write writes the n least significant bits of v.
+func (w *lsbWriter) write(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// bytes returns the bits written, the final byte holding any remaining
+// bits.
+func (w *lsbWriter) bytes() []byte {
+	if w.nbits > 0 {
+		return append(w.buf, byte(w.acc))
+	}
+	return w.buf
+}
+
+// IndexReader decompresses a file while building an Index of it.
+type IndexReader struct {
+	r     io.Reader
+	pr    *io.PipeReader
+	index *Index
+	done  bool
+}
+
+// NewIndexReader returns an IndexReader of the file f, with gzip
+// checkpoints every span uncompressed bytes. A span of zero or less
+// uses DefaultIndexSpan. The Index is available once the IndexReader
+// has been read to the end.
+func NewIndexReader(f *os.File, span int64) (*IndexReader, error) {
+	if span <= 0 {
+		span = DefaultIndexSpan
+	}
+	u, err := newUncompress(f)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ir := &IndexReader{
+		index: &Index{mime: u.MIME, fileSize: fi.Size()},
+	}
+
+	switch u.MIME {
+	case "application/gzip":
+		pr, pw := io.Pipe()
+		ir.r, ir.pr = pr, pr
+		go func() {
+			_ = pw.CloseWithError(ir.index.indexGzip(f, pw, span))
+		}()
+	case "application/x-xz":
+		if _, err := readXZIndex(f, fi.Size()); err != nil {
+			return nil, err
+		}
+		ir.r, err = xz.NewReader(f)
+	case "application/x-bzip2":
+		ir.r = bzip2.NewReader(f)
+	default:
+		ir.r = f
+	}
+	return ir, err
+}
+
+// Read reads the uncompressed contents of the file.
+func (ir *IndexReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	ir.index.size += int64(n)
+	if err == io.EOF {
+		ir.done = true
+	}
+	return n, err
+}
+
+// Close stops decompression.
+func (ir *IndexReader) Close() error {
+	if ir.pr != nil {
+		return ir.pr.Close()
+	}
+	return nil
+}
+
+// Index returns the Index of the file, or ErrIndexIncomplete if the
+// IndexReader has not been read to the end.
+func (ir *IndexReader) Index() (*Index, error) {
+	if !ir.done {
+		return nil, ErrIndexIncomplete
+	}
+	return ir.index, nil
+}
+
+// indexGzip decompresses the gzip file f to w, recording checkpoints
+// at the start of each member and at deflate blocks at least span
+// uncompressed bytes after the previous checkpoint.
+func (x *Index) indexGzip(f io.Reader, w io.Writer, span int64) error {
+	inf := newInflater(f, func(b []byte) error {
+		_, err := w.Write(b)
+		return err
+	})
+	var last int64 // uncompressed offset of the last checkpoint
+	inf.block = func(bitPos int64) error {
+		if inf.out-last >= span {
+			x.checkpoints = append(x.checkpoints, gzipCheckpoint{
+				In:     bitPos,
+				Out:    inf.out,
+				Window: inf.window(),
+			})
+			last = inf.out
+		}
+		return nil
+	}
+
+	for {
+		start := len(x.checkpoints)
+		x.checkpoints = append(x.checkpoints, gzipCheckpoint{
+			In:     inf.in * 8,
+			Out:    inf.out,
+			Member: true,
+		})
+		last = inf.out
+		if err := inf.gzipMember(); err != nil {
+			return err
+		}
+		for i := range x.checkpoints[start:] {
+			x.checkpoints[start+i].End = inf.in
+		}
+		if _, err := inf.r.Peek(1); err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// gzipMember decodes a gzip member, checking its header and trailer.
+func (f *inflater) gzipMember() error {
+	header := make([]byte, 10)
+	for i := range header {
+		b, err := f.getBits(8)
+		if err != nil {
+			return err
+		}
+		header[i] = byte(b)
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 0x08 {
+		return gzip.ErrHeader
+	}
+	flags := header[3]
+	skipString := func() error {
+		for {
+			b, err := f.getBits(8)
+			if err != nil || b == 0 {
+				return err
+			}
+		}
+	}
+	if flags&0x04 != 0 { // FEXTRA
+		xlen, err := f.getBits(16)
+		if err != nil {
+			return err
+		}
+		for range xlen {
+			if _, err := f.getBits(8); err != nil {
+				return err
+			}
+		}
+	}
+	if flags&0x08 != 0 { // FNAME
+		if err := skipString(); err != nil {
+			return err
+		}
+	}
+	if flags&0x10 != 0 { // FCOMMENT
+		if err := skipString(); err != nil {
+			return err
+		}
+	}
+	if flags&0x02 != 0 { // FHCRC
+		if _, err := f.getBits(16); err != nil {
+			return err
+		}
+	}
+
+	f.reset()
+	start := f.out
+	if err := f.inflate(); err != nil {
+		return err
+	}
+	f.alignByte()
+	crc, err := f.getBits(32)
+	if err != nil {
+		return err
+	}
+	size, err := f.getBits(32)
+	if err != nil {
+		return err
+	}
+	if crc != f.crc || size != uint32(f.out-start) {
+		return gzip.ErrChecksum
+	}
+	return nil
+}
+
+// indexFile is the encoding of an Index.
+type indexFile struct {
+	Version     int
+	MIME        string
+	Size        int64
+	FileSize    int64
+	Checkpoints []gzipCheckpoint
+}
+
+// MarshalBinary encodes the Index, compressing the checkpoint windows.
+func (x *Index) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	err := gob.NewEncoder(zw).Encode(indexFile{
+		Version:     indexVersion,
+		MIME:        x.mime,
+		Size:        x.size,
+		FileSize:    x.fileSize,
+		Checkpoints: x.checkpoints,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an Index encoded by MarshalBinary.
+func (x *Index) UnmarshalBinary(data []byte) error {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var i indexFile
+	if err := gob.NewDecoder(zr).Decode(&i); err != nil {
+		return err
+	}
+	if i.Version != indexVersion {
+		return fmt.Errorf("index version %d not supported", i.Version)
+	}
+	*x = Index{
+		mime:        i.MIME,
+		size:        i.Size,
+		fileSize:    i.FileSize,
+		checkpoints: i.Checkpoints,
+	}
+	return nil
+}
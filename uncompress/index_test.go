@@ -0,0 +1,178 @@
+package uncompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGzip writes data to a gzip file at path as members of up to
+// memberSize bytes, flushing every flushSize bytes to start new deflate
+// blocks.
+func writeGzip(t *testing.T, path string, data []byte, level, memberSize, flushSize int) {
+	t.Helper()
+	var b bytes.Buffer
+	for len(data) > 0 {
+		member := data[:min(memberSize, len(data))]
+		data = data[len(member):]
+		gw, err := gzip.NewWriterLevel(&b, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gw.Name = "member"
+		for len(member) > 0 {
+			chunk := member[:min(flushSize, len(member))]
+			member = member[len(chunk):]
+			if _, err := gw.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+			if err := gw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	mbox, err := os.ReadFile("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	blocks := filepath.Join(dir, "blocks.gz")
+	writeGzip(t, blocks, mbox, gzip.DefaultCompression, len(mbox), 1500)
+	huffman := filepath.Join(dir, "huffman.gz")
+	writeGzip(t, huffman, mbox, gzip.HuffmanOnly, len(mbox), 3000)
+	stored := filepath.Join(dir, "stored.gz")
+	writeGzip(t, stored, mbox, gzip.NoCompression, len(mbox), 3000)
+	members := filepath.Join(dir, "members.gz")
+	writeGzip(t, members, mbox, gzip.BestSpeed, 5000, 700)
+
+	tests := []struct {
+		file        string
+		checkpoints int // minimum gzip checkpoints
+	}{
+		{"testdata/golang.mbox", 0},
+		{"testdata/golang.mbox.bz2", 0},
+		{"testdata/golang.mbox.xz", 0},
+		{"testdata/golang.blocks.mbox.xz", 0},
+		{"testdata/golang.mbox.gz", 1},
+		{blocks, 5},
+		{huffman, 5},
+		{stored, 5},
+		{members, 6},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			f, err := os.Open(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			ir, err := NewIndexReader(f, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ir.Index(); err != ErrIndexIncomplete {
+				t.Errorf("expected ErrIndexIncomplete, got %v", err)
+			}
+			got, err := io.ReadAll(ir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, mbox) {
+				t.Fatalf("output differs: got %d bytes want %d", len(got), len(mbox))
+			}
+			idx, err := ir.Index()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := idx.Size(), int64(len(mbox)); got != want {
+				t.Errorf("size got %d want %d", got, want)
+			}
+			if got, want := len(idx.checkpoints), tt.checkpoints; got < want {
+				t.Errorf("checkpoints got %d want at least %d", got, want)
+			}
+
+			// round trip the index encoding
+			b, err := idx.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx = &Index{}
+			if err := idx.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, off := range []int64{0, 1, 4095, 4096, 10000, 17777, 26000, int64(len(mbox))} {
+				r, err := idx.Reader(f, off)
+				if err != nil {
+					t.Fatalf("offset %d: %s", off, err)
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("offset %d: %s", off, err)
+				}
+				if !bytes.Equal(got, mbox[off:]) {
+					t.Errorf("offset %d: output differs: got %d bytes want %d", off, len(got), len(mbox)-int(off))
+				}
+			}
+			if _, err := idx.Reader(f, int64(len(mbox))+1); err == nil {
+				t.Error("expected out of range error")
+			}
+		})
+	}
+}
+
+func TestAlignDeflate(t *testing.T) {
+	mbox, err := os.ReadFile("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	fw, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(mbox); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+
+	for shift := uint(1); shift < 8; shift++ {
+		// data following shift bits of another block
+		shifted := []byte{0xff >> (8 - shift)}
+		for _, c := range data {
+			shifted[len(shifted)-1] |= c << shift
+			shifted = append(shifted, c>>(8-shift))
+		}
+		r, err := alignDeflate(bytes.NewReader(shifted), shift)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(flate.NewReader(r))
+		if err != nil {
+			t.Fatalf("shift %d: %s", shift, err)
+		}
+		if !bytes.Equal(got, mbox) {
+			t.Errorf("shift %d: output differs", shift)
+		}
+	}
+}
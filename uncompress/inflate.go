@@ -0,0 +1,423 @@
+package uncompress
+
+// inflate provides a deflate decoder, after zlib's puff.c, which reports
+// the start of each deflate block, with its bit offset in the
+// compressed data and the uncompressed data preceding it. compress/flate
+// does not expose block boundaries, which are needed to build an index
+// from which compress/flate can resume decompression, in the manner of
+// zlib's zran.c.
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	maxCodeBits   = 15      // maximum bits in a deflate code
+	maxLitCodes   = 286     // maximum literal/length codes
+	maxDistCodes  = 30      // maximum distance codes
+	windowSize    = 1 << 15 // deflate history window
+	inflateFlush  = 1 << 18 // uncompressed bytes buffered before emitting
+	endOfBlockSym = 256
+)
+
+// errDeflate reports invalid deflate data.
+var errDeflate = errors.New("invalid deflate data")
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// codeLengthOrder is the order of the code length code lengths
+	codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// fixedLit and fixedDist are the fixed huffman codes.
+var fixedLit, fixedDist = func() (*huffman, *huffman) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	lit, _ := newHuffman(lengths[:])
+	var dist [30]uint8
+	for i := range dist {
+		dist[i] = 5
+	}
+	d, _ := newHuffman(dist[:])
+	return lit, d
+}()
+
+// huffman is a canonical huffman code, held as the number of codes of
+// each length and the symbols ordered by code.
+type huffman struct {
+	count  [maxCodeBits + 1]uint16
+	symbol []uint16
+}
+
+// newHuffman builds a huffman code from the code length of each
+// symbol. Incomplete codes are permitted, as codes which are not
+// assigned fail to decode.
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{symbol: make([]uint16, len(lengths))}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return nil, errDeflate // over-subscribed
+		}
+	}
+	var offs [maxCodeBits + 1]uint16
+	for l := 1; l < maxCodeBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+	return h, nil
+}
+
+// inflater decodes deflate data read from r, emitting the uncompressed
+// data in order.
+type inflater struct {
+	r       *bufio.Reader
+	in      int64  // bytes read from r
+	bits    uint64 // bits read from r but not yet used
+	nbits   uint
+	hist    []byte // uncompressed data, from at least windowSize bytes before emitted
+	emitted int    // bytes of hist emitted
+	out     int64  // uncompressed bytes decoded
+	crc     uint32 // checksum of the data emitted since resetCRC
+	emit    func([]byte) error
+	// block, if not nil, is called at the start of each deflate block
+	block func(bitPos int64) error
+}
+
+// newInflater returns an inflater reading from r.
+func newInflater(r io.Reader, emit func([]byte) error) *inflater {
+	return &inflater{
+		r:    bufio.NewReader(r),
+		hist: make([]byte, 0, inflateFlush+windowSize+maxMatch),
+		emit: emit,
+	}
+}
+
+// maxMatch is the longest deflate back reference.
+const maxMatch = 258
+
+// bitPos is the offset in bits of the next unread bit of r.
+func (f *inflater) bitPos() int64 {
+	return f.in*8 - int64(f.nbits)
+}
+
+// need ensures at least n bits are held, n being at most 56.
+func (f *inflater) need(n uint) error {
+	for f.nbits < n {
+		b, err := f.r.ReadByte()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		f.in++
+		f.bits |= uint64(b) << f.nbits
+		f.nbits += 8
+	}
+	return nil
+}
+
+// getBits reads n bits, least significant bit first.
+func (f *inflater) getBits(n uint) (uint32, error) {
+	if err := f.need(n); err != nil {
+		return 0, err
+	}
+	v := uint32(f.bits & (1<<n - 1))
+	f.bits >>= n
+	f.nbits -= n
+	return v, nil
+}
+
+// alignByte discards the bits up to the next byte boundary.
+func (f *inflater) alignByte() {
+	drop := f.nbits % 8
+	f.bits >>= drop
+	f.nbits -= drop
+}
+
+// decode decodes a symbol using huffman code h. Codes are read most
+// significant bit first.
+func (f *inflater) decode(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		if f.nbits == 0 {
+			if err := f.need(1); err != nil {
+				return 0, err
+			}
+		}
+		code |= int(f.bits & 1)
+		f.bits >>= 1
+		f.nbits--
+		count := int(h.count[l])
+		if code-count < first {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errDeflate
+}
+
+// inflate decodes deflate blocks until the final block.
+func (f *inflater) inflate() error {
+	for {
+		if f.block != nil {
+			if err := f.block(f.bitPos()); err != nil {
+				return err
+			}
+		}
+		header, err := f.getBits(3)
+		if err != nil {
+			return err
+		}
+		switch header >> 1 {
+		case 0:
+			err = f.stored()
+		case 1:
+			err = f.codes(fixedLit, fixedDist)
+		case 2:
+			err = f.dynamic()
+		default:
+			err = errDeflate
+		}
+		if err != nil {
+			return err
+		}
+		if header&1 == 1 {
+			return f.flush()
+		}
+	}
+}
+
+// stored copies a stored block.
+func (f *inflater) stored() error {
+	f.alignByte()
+	length, err := f.getBits(16)
+	if err != nil {
+		return err
+	}
+	nlength, err := f.getBits(16)
+	if err != nil {
+		return err
+	}
+	if length != ^nlength&0xffff {
+		return errDeflate
+	}
+	for range length {
+		b, err := f.getBits(8)
+		if err != nil {
+			return err
+		}
+		if err := f.put(byte(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dynamic decodes a block with dynamic huffman codes.
+func (f *inflater) dynamic() error {
+	v, err := f.getBits(14)
+	if err != nil {
+		return err
+	}
+	nlen := int(v&0x1f) + 257
+	ndist := int(v>>5&0x1f) + 1
+	ncode := int(v>>10) + 4
+	if nlen > maxLitCodes || ndist > maxDistCodes {
+		return errDeflate
+	}
+
+	var lengths [maxLitCodes + maxDistCodes]uint8
+	for i := range ncode {
+		l, err := f.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLengthOrder[i]] = uint8(l)
+	}
+	lencode, err := newHuffman(lengths[:19])
+	if err != nil {
+		return err
+	}
+
+	for i := range 19 {
+		lengths[i] = 0
+	}
+	for index := 0; index < nlen+ndist; {
+		sym, err := f.decode(lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[index] = uint8(sym)
+			index++
+			continue
+		}
+		var (
+			l   uint8
+			rep uint32
+		)
+		switch sym {
+		case 16:
+			if index == 0 {
+				return errDeflate
+			}
+			l = lengths[index-1]
+			rep, err = f.getBits(2)
+			rep += 3
+		case 17:
+			rep, err = f.getBits(3)
+			rep += 3
+		default:
+			rep, err = f.getBits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if index+int(rep) > nlen+ndist {
+			return errDeflate
+		}
+		for range rep {
+			lengths[index] = l
+			index++
+		}
+	}
+	if lengths[endOfBlockSym] == 0 {
+		return errDeflate
+	}
+
+	lit, err := newHuffman(lengths[:nlen])
+	if err != nil {
+		return err
+	}
+	dist, err := newHuffman(lengths[nlen : nlen+ndist])
+	if err != nil {
+		return err
+	}
+	return f.codes(lit, dist)
+}
+
+// codes decodes the literals and back references of a block.
+func (f *inflater) codes(lit, dist *huffman) error {
+	for {
+		sym, err := f.decode(lit)
+		if err != nil {
+			return err
+		}
+		if sym < endOfBlockSym {
+			if err := f.put(byte(sym)); err != nil {
+				return err
+			}
+			continue
+		}
+		if sym == endOfBlockSym {
+			return nil
+		}
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errDeflate
+		}
+		extra, err := f.getBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(extra)
+
+		dsym, err := f.decode(dist)
+		if err != nil {
+			return err
+		}
+		if dsym >= len(distBase) {
+			return errDeflate
+		}
+		extra, err = f.getBits(uint(distExtra[dsym]))
+		if err != nil {
+			return err
+		}
+		distance := int(distBase[dsym]) + int(extra)
+		if distance > len(f.hist) {
+			return errDeflate
+		}
+		for range length {
+			f.hist = append(f.hist, f.hist[len(f.hist)-distance])
+		}
+		f.out += int64(length)
+		if len(f.hist) >= inflateFlush+windowSize {
+			if err := f.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// put adds a literal byte to the output.
+func (f *inflater) put(b byte) error {
+	f.hist = append(f.hist, b)
+	f.out++
+	if len(f.hist) >= inflateFlush+windowSize {
+		return f.flush()
+	}
+	return nil
+}
+
+// flush emits the output not yet emitted, retaining the last
+// windowSize bytes as history.
+func (f *inflater) flush() error {
+	pending := f.hist[f.emitted:]
+	f.crc = crc32.Update(f.crc, crc32.IEEETable, pending)
+	if err := f.emit(pending); err != nil {
+		return err
+	}
+	if len(f.hist) > windowSize {
+		n := copy(f.hist, f.hist[len(f.hist)-windowSize:])
+		f.hist = f.hist[:n]
+	}
+	f.emitted = len(f.hist)
+	return nil
+}
+
+// window returns a copy of up to windowSize bytes of the uncompressed
+// data preceding the current position.
+func (f *inflater) window() []byte {
+	w := f.hist[max(len(f.hist)-windowSize, 0):]
+	return append([]byte(nil), w...)
+}
+
+// reset clears the history and checksum, for a new gzip member.
+func (f *inflater) reset() {
+	f.hist = f.hist[:0]
+	f.emitted = 0
+	f.crc = 0
+}
@@ -0,0 +1,166 @@
+package uncompress
+
+// limits provides protection against decompression bombs, small
+// compressed files which expand to consume excessive memory or disk.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ratioGrace is the number of uncompressed bytes read before the
+// expansion ratio limit is enforced, since small files with high
+// ratios are harmless.
+const ratioGrace = 1 << 20
+
+// ErrLimitExceeded is wrapped by LimitError.
+var ErrLimitExceeded error = errors.New("decompression limit exceeded")
+
+// LimitError reports a decompression limit being exceeded.
+type LimitError struct {
+	Limit string // "bytes", "ratio" or "dictionary"
+	Max   int64  // the configured limit
+	Value int64  // the value found
+}
+
+func (l *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s %d over maximum %d", ErrLimitExceeded, l.Limit, l.Value, l.Max)
+}
+
+// Unwrap returns ErrLimitExceeded.
+func (l *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader, counting the bytes read.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedReader enforces maximum uncompressed bytes and expansion
+// ratio limits, if any, on a decompressing reader, and counts the bytes
+// read.
+type limitedReader struct {
+	r        io.Reader    // decompressing reader
+	in       func() int64 // compressed bytes read
+	out      int64        // uncompressed bytes read
+	maxBytes int64
+	maxRatio int64
+	wait     time.Duration // time spent reading from r
+}
+
+// Read reads from the decompressing reader, returning a LimitError
+// once a limit is exceeded.
+func (l *limitedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := l.r.Read(p)
+	l.wait += time.Since(start)
+	l.out += int64(n)
+	if l.maxBytes > 0 && l.out > l.maxBytes {
+		read := l.out
+		n -= int(l.out - l.maxBytes)
+		l.out = l.maxBytes
+		return n, &LimitError{"bytes", l.maxBytes, read}
+	}
+	if l.maxRatio > 0 && l.out > ratioGrace {
+		if in := l.in(); in > 0 && l.out/in > l.maxRatio {
+			ratio := l.out / in
+			return n, &LimitError{"ratio", l.maxRatio, ratio}
+		}
+	}
+	return n, err
+}
+
+// segmentLimits enforces the maximum uncompressed bytes and expansion
+// ratio limits, if any, while segments are decoded concurrently, so
+// that a decompression bomb is stopped before it is decoded in full
+// rather than once its output is read.
+type segmentLimits struct {
+	maxBytes int64
+	maxRatio int64
+	used     atomic.Int64 // uncompressed bytes decoded by all segments
+}
+
+// read reads up to maxSegmentBytes of the output of a segment of size
+// compressed bytes from the decompressing reader r, returning the
+// reader of the rest of the output of a larger segment, if any, to be
+// read in turn. A LimitError is returned once the bytes decoded by all
+// segments or the expansion ratio of this segment exceed a limit. The
+// bytes of a segment which cannot be decoded are released from the
+// total.
+func (l *segmentLimits) read(r io.Reader, size int64) ([]byte, io.Reader, error) {
+	sr := &segmentReader{r: r, l: l, size: size}
+	out, err := io.ReadAll(io.LimitReader(sr, maxSegmentBytes))
+	if err != nil && !errors.Is(err, ErrLimitExceeded) {
+		l.release(sr.out)
+	}
+	if err != nil || len(out) < maxSegmentBytes {
+		return out, nil, err
+	}
+	return out, sr, nil
+}
+
+// release removes n bytes, no longer held, from the total decoded.
+func (l *segmentLimits) release(n int64) {
+	l.used.Add(-n)
+}
+
+// segmentReader enforces segmentLimits on the decompressing reader of
+// a segment.
+type segmentReader struct {
+	r    io.Reader
+	l    *segmentLimits
+	size int64 // compressed bytes of the segment
+	out  int64 // uncompressed bytes read
+}
+
+// Read reads from the decompressing reader, returning a LimitError
+// once a limit is exceeded.
+func (s *segmentReader) Read(p []byte) (int, error) {
+	if s.l.maxBytes > 0 {
+		remaining := max(s.l.maxBytes-s.l.used.Load(), 0)
+		if int64(len(p)) > remaining+1 {
+			p = p[:remaining+1]
+		}
+	}
+	n, err := s.r.Read(p)
+	s.out += int64(n)
+	used := s.l.used.Add(int64(n))
+	if s.l.maxBytes > 0 && used > s.l.maxBytes {
+		return n, &LimitError{"bytes", s.l.maxBytes, used}
+	}
+	if s.l.maxRatio > 0 && s.out > ratioGrace && s.size > 0 && s.out/s.size > s.l.maxRatio {
+		return n, &LimitError{"ratio", s.l.maxRatio, s.out / s.size}
+	}
+	return n, err
+}
+
+// BytesRead returns the compressed and uncompressed bytes read.
+func (l *limitedReader) BytesRead() (compressed, uncompressed int64) {
+	return l.in(), l.out
+}
+
+// ReadTime returns the time spent reading from the decompressing
+// reader.
+func (l *limitedReader) ReadTime() time.Duration {
+	return l.wait
+}
+
+// Close closes the decompressing reader, if it is an io.Closer.
+func (l *limitedReader) Close() error {
+	if c, ok := l.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package uncompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	// bomb.gz expands 8MiB of zeros from a few KiB
+	bomb := filepath.Join(t.TempDir(), "bomb.gz")
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	if _, err := gw.Write(make([]byte, 8<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bomb, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file  string
+		opts  []Option
+		limit string // expected limit error, if any
+		len   int
+	}{
+		{"testdata/golang.mbox.gz", []Option{WithMaxBytes(1000)}, "bytes", 1000},
+		{"testdata/golang.mbox.gz", []Option{WithMaxBytes(30000)}, "", 26097},
+		{"testdata/golang.mbox", []Option{WithMaxBytes(1000)}, "bytes", 1000},
+		{bomb, []Option{WithMaxRatio(100)}, "ratio", -1},
+		{bomb, []Option{WithMaxRatio(10000)}, "", 8 << 20},
+		{"testdata/golang.mbox.xz", []Option{WithMaxDictSize(1 << 20)}, "dictionary", 0},
+		{"testdata/golang.blocks.mbox.xz", []Option{WithMaxDictSize(1 << 20)}, "dictionary", 0},
+		{"testdata/golang.blocks.mbox.xz", []Option{WithMaxDictSize(8 << 20)}, "", 26097},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			f, err := os.Open(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			var contents []byte
+			r, err := NewReader(f, tt.opts...)
+			if err == nil {
+				contents, err = io.ReadAll(r)
+			}
+			var le *LimitError
+			if tt.limit == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if !errors.As(err, &le) || !errors.Is(err, ErrLimitExceeded) {
+					t.Fatalf("expected limit error, got %v", err)
+				}
+				if got, want := le.Limit, tt.limit; got != want {
+					t.Errorf("limit got %s want %s", got, want)
+				}
+				if le.Value <= le.Max {
+					t.Errorf("limit value %d not over maximum %d", le.Value, le.Max)
+				}
+			}
+			if tt.len >= 0 {
+				if got, want := len(contents), tt.len; got != want {
+					t.Errorf("len got %d want %d", got, want)
+				}
+			}
+		})
+	}
+}
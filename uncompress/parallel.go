@@ -0,0 +1,228 @@
+package uncompress
+
+// parallel provides concurrent decompression of the independently
+// decodable segments of compressed files, such as bzip2 and xz blocks
+// and gzip members. The output of each segment is provided in order as
+// a single stream.
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// segment is an independently decodable part of a compressed file.
+type segment interface {
+	// decode decompresses the segment within the limits l, returning
+	// up to maxSegmentBytes of its output and, for a larger segment,
+	// the reader of the rest of its output.
+	decode(l *segmentLimits) ([]byte, io.Reader, error)
+	// merge joins the segment with the following segment, if
+	// possible. Segments are found by searching for markers which may
+	// also occur by chance in compressed data, splitting a segment in
+	// two, neither of which can be decoded.
+	merge(next segment) (segment, bool)
+	// size is the compressed size of the segment.
+	size() int64
+}
+
+// segmentFunc provides the segments of a compressed file in order to
+// yield, returning any error encountered while finding the segments.
+type segmentFunc func(yield func(segment) bool) error
+
+// maxSegmentBytes is the output of a segment decoded in advance of
+// being read. The rest of the output of a larger segment is decoded as
+// it is read, so that up to n segments being decoded or awaiting
+// reading hold no more than n times maxSegmentBytes.
+const maxSegmentBytes = 16 << 20
+
+// maxMerges is the number of following segments a segment which
+// cannot be decoded is merged with before its error is returned.
+const maxMerges = 2
+
+// falseBoundary reports if the decoding error err may be caused by a
+// segment ending at a false boundary. A checksum mismatch is found only
+// once a segment has been decoded to its end, showing the segment to be
+// damaged, and a limit error is final.
+func falseBoundary(err error) bool {
+	var se bzip2.StructuralError
+	if errors.As(err, &se) && strings.Contains(string(se), "checksum") {
+		return false
+	}
+	return !errors.Is(err, gzip.ErrChecksum) && !errors.Is(err, ErrLimitExceeded)
+}
+
+// result is the result of decoding a segment.
+type result struct {
+	seg  segment
+	out  []byte
+	rest io.Reader // the rest of the output of a large segment
+	err  error
+}
+
+// parallelReader is an io.Reader decoding segments concurrently and
+// providing their output in order.
+type parallelReader struct {
+	futures    chan chan result
+	done       chan struct{}
+	limits     *segmentLimits
+	closeOnce  sync.Once
+	buf        []byte
+	rest       io.Reader // the rest of the output of the current segment
+	err        error
+	compressed int64 // compressed bytes of the segments read
+}
+
+// newParallelReader decodes the segments provided by segments with up
+// to n segments decoded or awaiting reading at any time, within the
+// limits l.
+func newParallelReader(n int, segments segmentFunc, l *segmentLimits) *parallelReader {
+	p := &parallelReader{
+		futures: make(chan chan result, n),
+		done:    make(chan struct{}),
+		limits:  l,
+	}
+	go func() {
+		defer close(p.futures)
+		err := segments(func(s segment) bool {
+			fut := make(chan result, 1)
+			select {
+			case p.futures <- fut:
+			case <-p.done:
+				return false
+			}
+			go func() {
+				out, rest, err := s.decode(l)
+				fut <- result{s, out, rest, err}
+			}()
+			return true
+		})
+		if err != nil {
+			fut := make(chan result, 1)
+			fut <- result{err: err}
+			select {
+			case p.futures <- fut:
+			case <-p.done:
+			}
+		}
+	}()
+	return p
+}
+
+// Read reads the decoded output of the segments in order.
+func (p *parallelReader) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.rest != nil {
+			n, err := p.rest.Read(b)
+			if err != nil {
+				p.rest = nil
+				if err != io.EOF {
+					p.err = err
+				}
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if p.err != nil {
+			return 0, p.err
+		}
+		fut, ok := <-p.futures
+		if !ok {
+			p.err = io.EOF
+			continue
+		}
+		r := <-fut
+		// a segment which cannot be decoded may end at a false
+		// boundary, so try merging it with the following segments
+		for merges := 0; merges < maxMerges && r.err != nil && r.seg != nil && falseBoundary(r.err); merges++ {
+			nextFut, ok := <-p.futures
+			if !ok {
+				break
+			}
+			next := <-nextFut
+			if next.seg == nil {
+				break
+			}
+			merged, ok := r.seg.merge(next.seg)
+			if !ok {
+				break
+			}
+			p.limits.release(int64(len(next.out)))
+			out, rest, err := merged.decode(p.limits)
+			r = result{merged, out, rest, err}
+		}
+		if r.err != nil {
+			p.err = r.err
+			continue
+		}
+		p.compressed += r.seg.size()
+		p.buf, p.rest = r.out, r.rest
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// Close stops the decoding of further segments.
+func (p *parallelReader) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+// bitWriter writes bits, most significant bit first.
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint // bits held in acc
+}
+
+// writeBits writes the n least significant bits of v.
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		k := min(n, 8)
+		n -= k
+		w.acc = w.acc<<k | (v>>n)&(1<<k-1)
+		w.n += k
+		if w.n >= 8 {
+			w.n -= 8
+			w.buf = append(w.buf, byte(w.acc>>w.n))
+		}
+	}
+}
+
+// writeBitRange writes the bits of src from bit offset start to end.
+func (w *bitWriter) writeBitRange(src []byte, start, end int64) {
+	for pos := start; pos < end; {
+		avail := 8 - uint(pos%8)
+		k := min(avail, uint(end-pos))
+		v := uint64(src[pos/8]) >> (avail - k)
+		w.writeBits(v, k)
+		pos += int64(k)
+	}
+}
+
+// bytes returns the bits written, padded with zeros to a byte
+// boundary.
+func (w *bitWriter) bytes() []byte {
+	if w.n > 0 {
+		return append(w.buf, byte(w.acc<<(8-w.n)))
+	}
+	return w.buf
+}
+
+// bitsAt reads n bits from src at bit offset off.
+func bitsAt(src []byte, off int64, n uint) uint64 {
+	var v uint64
+	for i := range int64(n) {
+		bit := (src[(off+i)/8] >> (7 - uint((off+i)%8))) & 1
+		v = v<<1 | uint64(bit)
+	}
+	return v
+}
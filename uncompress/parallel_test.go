@@ -0,0 +1,425 @@
+package uncompress
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestParallel(t *testing.T) {
+	mbox, err := os.ReadFile("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// members.gz holds each message of golang.mbox as a gzip member
+	members := filepath.Join(dir, "members.gz")
+	var gz bytes.Buffer
+	for _, part := range bytes.SplitAfter(mbox, []byte("\nFrom ")) {
+		gw := gzip.NewWriter(&gz)
+		if _, err := gw.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(members, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// bgzf.gz holds each message of golang.mbox as a BGZF block
+	bgzf := filepath.Join(dir, "bgzf.gz")
+	var bg []byte
+	for _, part := range bytes.SplitAfter(mbox, []byte("\nFrom ")) {
+		bg = append(bg, bgzfBlock(t, part)...)
+	}
+	if err := os.WriteFile(bgzf, bg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// streams.bz2 holds two concatenated bzip2 streams
+	streams := filepath.Join(dir, "streams.bz2")
+	bz, err := os.ReadFile("testdata/golang.mbox.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(streams, append(bz, bz...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file string
+		want []byte
+	}{
+		{"testdata/golang.mbox", mbox},
+		{"testdata/golang.mbox.bz2", mbox},
+		{"testdata/golang.blocks.mbox.bz2", bytes.Repeat(mbox, 5)},
+		{streams, bytes.Repeat(mbox, 2)},
+		{"testdata/golang.mbox.xz", mbox},
+		{"testdata/golang.blocks.mbox.xz", mbox},
+		{"testdata/golang.mbox.gz", mbox},
+		{members, mbox},
+		{bgzf, mbox},
+	}
+	for i, tt := range tests {
+		for _, n := range []int{2, 8} {
+			t.Run(fmt.Sprintf("test_%d_parallel_%d", i, n), func(t *testing.T) {
+				f, err := os.Open(tt.file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+
+				r, err := NewReader(f, WithParallel(n), WithMaxRatio(1000))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.want) {
+					t.Errorf("output differs: got %d bytes want %d", len(got), len(tt.want))
+				}
+			})
+		}
+	}
+}
+
+// bgzfBlock returns data compressed as a BGZF block, a gzip member
+// recording its size in the BC subfield of its extra field.
+func bgzfBlock(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	gw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	block := b.Bytes()
+	binary.LittleEndian.PutUint16(block[16:], uint16(len(block)-1))
+	return block
+}
+
+func TestGzipMultiMember(t *testing.T) {
+	mbox, err := os.ReadFile("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped := func(data ...[]byte) []byte {
+		var b bytes.Buffer
+		for _, d := range data {
+			gw := gzip.NewWriter(&b)
+			if _, err := gw.Write(d); err != nil {
+				t.Fatal(err)
+			}
+			if err := gw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b.Bytes()
+	}
+	// random data does not compress, so a member of it is longer
+	// than gzipSearchBytes
+	random := make([]byte, gzipSearchBytes+1)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		data []byte
+		want bool
+	}{
+		{gzipped(mbox), false},
+		{gzipped(mbox, mbox), true},
+		{gzipped(random, mbox), false},
+		{bgzfBlock(t, mbox), false},
+		{append(bgzfBlock(t, mbox), bgzfBlock(t, mbox)...), true},
+	}
+	for i, tt := range tests {
+		r := bytes.NewReader(tt.data)
+		if got := gzipMultiMember(r, r.Size()); got != tt.want {
+			t.Errorf("test %d: got %t want %t", i, got, tt.want)
+		}
+	}
+}
+
+func TestParallelClose(t *testing.T) {
+	f, err := os.Open("testdata/golang.blocks.mbox.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	r, err := NewReader(f, WithParallel(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*limitedReader).r.(*parallelReader); !ok {
+		t.Fatalf("expected parallelReader, got %T", r.(*limitedReader).r)
+	}
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	// segments queued before closing are still provided in order
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBitWriter(t *testing.T) {
+	src := []byte{0b10110011, 0b01011100}
+	w := &bitWriter{}
+	w.writeBitRange(src, 3, 13)
+	if got, want := w.bytes(), []byte{0b10011010, 0b11000000}; !bytes.Equal(got, want) {
+		t.Errorf("got %08b want %08b", got, want)
+	}
+	if got, want := bitsAt(src, 3, 10), uint64(0b1001101011); got != want {
+		t.Errorf("bitsAt got %b want %b", got, want)
+	}
+}
+
+func TestParallelLimits(t *testing.T) {
+	// bombs.gz holds four gzip members each expanding 8MiB of zeros
+	bombs := filepath.Join(t.TempDir(), "bombs.gz")
+	var gz bytes.Buffer
+	for range 4 {
+		gw := gzip.NewWriter(&gz)
+		if _, err := gw.Write(make([]byte, 8<<20)); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(bombs, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts  []Option
+		limit string
+	}{
+		{[]Option{WithMaxBytes(1 << 20)}, "bytes"},
+		{[]Option{WithMaxRatio(100)}, "ratio"},
+		{[]Option{WithMaxBytes(1 << 20), WithMaxRatio(100)}, "bytes"},
+		{[]Option{WithMaxBytes(64 << 20), WithMaxRatio(100)}, "ratio"},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			f, err := os.Open(bombs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			r, err := NewReader(f, append(tt.opts, WithParallel(4))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := r.(*limitedReader).r.(*parallelReader)
+			if !ok {
+				t.Fatalf("expected parallelReader, got %T", r.(*limitedReader).r)
+			}
+			_, err = io.ReadAll(r)
+			var le *LimitError
+			if !errors.As(err, &le) {
+				t.Fatalf("expected limit error, got %v", err)
+			}
+			if got, want := le.Limit, tt.limit; got != want {
+				t.Errorf("limit got %s want %s", got, want)
+			}
+			_ = p.Close()
+
+			// the segments stop decoding at the limit, well short of
+			// the 32MiB of the members in full
+			if used := p.limits.used.Load(); used > 16<<20 {
+				t.Errorf("segments decoded %d bytes", used)
+			}
+		})
+	}
+}
+
+// brokenSegment is a segment which cannot be decoded, counting the
+// merges made.
+type brokenSegment struct {
+	err    error
+	merges *int
+}
+
+func (s *brokenSegment) decode(*segmentLimits) ([]byte, io.Reader, error) { return nil, nil, s.err }
+func (s *brokenSegment) size() int64                                      { return 1 }
+
+func (s *brokenSegment) merge(next segment) (segment, bool) {
+	*s.merges++
+	return s, true
+}
+
+func TestParallelMerges(t *testing.T) {
+	tests := []struct {
+		err    error
+		merges int
+	}{
+		{io.ErrUnexpectedEOF, maxMerges},
+		{gzip.ErrChecksum, 0},
+		{bzip2.StructuralError("block checksum mismatch"), 0},
+		{&LimitError{"bytes", 1, 2}, 0},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			merges := 0
+			segments := func(yield func(segment) bool) error {
+				for range 10 {
+					if !yield(&brokenSegment{tt.err, &merges}) {
+						return nil
+					}
+				}
+				return nil
+			}
+			p := newParallelReader(2, segments, &segmentLimits{})
+			defer func() {
+				_ = p.Close()
+			}()
+			if _, err := io.ReadAll(p); !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v want %v", err, tt.err)
+			}
+			if merges != tt.merges {
+				t.Errorf("got %d merges want %d", merges, tt.merges)
+			}
+		})
+	}
+}
+
+func TestParallelLargeSegments(t *testing.T) {
+	mbox, err := os.ReadFile("testdata/golang.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat(mbox, maxSegmentBytes/len(mbox)+10)
+	want := slices.Concat(mbox, large, mbox)
+	dir := t.TempDir()
+
+	// large.gz holds a gzip member larger than maxSegmentBytes
+	// between two small members
+	var gz bytes.Buffer
+	for _, part := range [][]byte{mbox, large, mbox} {
+		gw := gzip.NewWriter(&gz)
+		if _, err := gw.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	largeGz := filepath.Join(dir, "large.gz")
+	if err := os.WriteFile(largeGz, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// large.xz holds blocks larger than maxSegmentBytes
+	var xb bytes.Buffer
+	xw, err := xz.WriterConfig{BlockSize: maxSegmentBytes + 1}.NewWriter(&xb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xw.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	largeXz := filepath.Join(dir, "large.xz")
+	if err := os.WriteFile(largeXz, xb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := readXZIndex(bytes.NewReader(xb.Bytes()), int64(xb.Len())); err != nil || len(idx.blocks) < 2 {
+		t.Fatalf("expected several xz blocks, got %v", err)
+	}
+
+	tests := []struct {
+		file     string
+		parallel bool
+	}{
+		{largeGz, true},
+		{largeXz, false},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("test_%d", i), func(t *testing.T) {
+			f, err := os.Open(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+
+			r, err := NewReader(f, WithParallel(2), WithMaxRatio(1000))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := r.(*limitedReader).r.(*parallelReader); ok != tt.parallel {
+				t.Errorf("got parallel %t want %t", ok, tt.parallel)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs: got %d bytes want %d", len(got), len(want))
+			}
+		})
+	}
+
+	// only maxSegmentBytes of the large member is decoded in advance
+	f, err := os.Open(largeGz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var offsets []int64
+	_ = gzipMembers(f, int64(gz.Len()), int64(gz.Len()), func(o int64) bool {
+		offsets = append(offsets, o)
+		return true
+	})
+	if len(offsets) != 2 {
+		t.Fatalf("got member offsets %v", offsets)
+	}
+	out, rest, err := (&gzipSegment{r: f, start: offsets[0], end: offsets[1]}).decode(&segmentLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != maxSegmentBytes || rest == nil {
+		t.Fatalf("got %d bytes decoded in advance, rest %v", len(out), rest)
+	}
+	n, err := io.Copy(io.Discard, rest)
+	if err != nil || int(n)+len(out) != len(large) {
+		t.Errorf("got %d bytes from rest, %v", n, err)
+	}
+}
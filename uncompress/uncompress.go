@@ -5,10 +5,13 @@
 package uncompress
 
 import (
+	"cmp"
 	"compress/bzip2"
 	"compress/gzip"
 	"io"
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/h2non/filetype"
 	"github.com/ulikunitz/xz"
@@ -59,6 +62,80 @@ func (u *uncompress) IsType(typer string) bool {
 	}
 }
 
+// Option configures NewReader.
+type Option func(*config)
+
+// config holds the decompression limits, parallelism and logger.
+type config struct {
+	maxBytes    int64
+	maxRatio    int64
+	maxDictSize int64
+	parallel    int
+	logger      *slog.Logger
+}
+
+// WithMaxBytes limits the total uncompressed bytes which may be read.
+func WithMaxBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBytes = n
+	}
+}
+
+// WithMaxRatio limits the ratio of uncompressed to compressed bytes,
+// checked once the first MiB of uncompressed data has been read.
+func WithMaxRatio(n int64) Option {
+	return func(c *config) {
+		c.maxRatio = n
+	}
+}
+
+// WithMaxDictSize limits the xz dictionary size, which determines the
+// memory required for decompression. The dictionary size of each block
+// listed in the xz index is checked before decompression starts. If the
+// index cannot be read only the first block is checked.
+func WithMaxDictSize(n int64) Option {
+	return func(c *config) {
+		c.maxDictSize = n
+	}
+}
+
+// WithParallel decompresses up to n independently compressed segments
+// concurrently: the blocks of bzip2 files, the blocks of xz files with
+// more than one block and the members of gzip files with more than one
+// member, such as those written by bgzip, pigz --independent or
+// pbzip2. A gzip file not written by bgzip is only decompressed
+// concurrently if its second member starts within its first MiB, and
+// an xz file only if its blocks expand to no more than 16MiB. Up to
+// 16MiB of the output of each segment is decoded in advance, the rest
+// of a larger segment being decoded as it is read. The output is
+// provided in order. Other files are decompressed sequentially.
+func WithParallel(n int) Option {
+	return func(c *config) {
+		c.parallel = n
+	}
+}
+
+// Counter reports the compressed bytes read from a file, and the
+// uncompressed bytes read from its decompressing reader. For files
+// which are not compressed the two are the same.
+type Counter interface {
+	BytesRead() (compressed, uncompressed int64)
+}
+
+// WithLogger sets the logger recording, at debug level, the
+// compression detected and the use of parallel decompression. By
+// default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// Timer reports the time spent reading and decompressing a file.
+type Timer interface {
+	ReadTime() time.Duration
+}
+
 // NewReader opens a file and attempts to determine its file type.
 // Depending on the file type, it will return an io.Reader wrapped by a
 // decompression reader.
@@ -71,21 +148,117 @@ func (u *uncompress) IsType(typer string) bool {
 // whereas others return:
 //
 //	io.Reader, error
-func NewReader(f *os.File) (io.Reader, error) {
+//
+// Options may set limits to protect against decompression bombs.
+// Exceeding a limit results in a *LimitError, either from NewReader or
+// from reading the returned io.Reader. With WithParallel the returned
+// reader may also be an io.Closer, which should be closed to stop
+// decompression if the reader is not read to the end. The returned
+// reader is a Counter reporting the bytes read and a Timer reporting the
+// time taken.
+func NewReader(f *os.File, opts ...Option) (io.Reader, error) {
+	c := config{}
+	for _, o := range opts {
+		o(&c)
+	}
+	if c.logger == nil {
+		c.logger = slog.New(slog.DiscardHandler)
+	}
+
 	u, err := newUncompress(f)
 	if err != nil {
 		return nil, err
 	}
+	c.logger.Debug("compression detected", "type", cmp.Or(u.MIME, "none"))
+
+	if c.maxDictSize > 0 && u.MIME == "application/x-xz" {
+		if err := checkXZDictSize(f, c.maxDictSize); err != nil {
+			return nil, err
+		}
+	}
 
-	r := io.Reader(f)
+	in := &countingReader{r: f}
+	compressed := func() int64 { return in.n }
+	r := io.Reader(in)
 
+	l := &segmentLimits{maxBytes: c.maxBytes, maxRatio: c.maxRatio}
+	if p := parallelReaderFor(f, in, u, c.parallel, l); p != nil {
+		c.logger.Debug("parallel decompression", "type", u.MIME, "workers", c.parallel)
+		r, compressed = p, func() int64 { return p.compressed }
+	} else {
+		switch u.MIME {
+		case "application/x-bzip2":
+			r = bzip2.NewReader(r)
+		case "application/x-xz":
+			r, err = xz.NewReader(r)
+		case "application/gzip":
+			r, err = gzip.NewReader(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &limitedReader{r: r, in: compressed, maxBytes: c.maxBytes, maxRatio: c.maxRatio}, nil
+}
+
+// parallelReaderFor returns a parallelReader decoding up to n segments
+// of f concurrently, or nil if n is less than two or f does not have
+// more than one independently compressed segment. bzip2 data is read
+// through in. Segments are decoded within the limits l.
+func parallelReaderFor(f *os.File, in io.Reader, u *uncompress, n int, l *segmentLimits) *parallelReader {
+	if n < 2 {
+		return nil
+	}
 	switch u.MIME {
 	case "application/x-bzip2":
-		return bzip2.NewReader(r), nil
+		return newParallelReader(n, bzip2Segments(in), l)
 	case "application/x-xz":
-		return xz.NewReader(r)
+		fi, err := f.Stat()
+		if err != nil {
+			return nil
+		}
+		idx, err := readXZIndex(f, fi.Size())
+		if err != nil || len(idx.blocks) < 2 {
+			return nil
+		}
+		// large blocks, such as those of xz -T0, are decoded
+		// sequentially, rather than held in memory in parallel
+		for _, b := range idx.blocks {
+			if b.uncompressedSize > maxSegmentBytes {
+				return nil
+			}
+		}
+		return newParallelReader(n, xzSegments(f, idx), l)
 	case "application/gzip":
-		return gzip.NewReader(r)
+		fi, err := f.Stat()
+		if err != nil || !gzipMultiMember(f, fi.Size()) {
+			return nil
+		}
+		return newParallelReader(n, gzipSegments(f, fi.Size()), l)
+	}
+	return nil
+}
+
+// checkXZDictSize checks that the dictionary size of the blocks in the
+// xz file f are no more than max.
+func checkXZDictSize(f *os.File, max int64) error {
+	offsets := []int64{xzStreamHeaderLen}
+	if fi, err := f.Stat(); err == nil {
+		if idx, err := readXZIndex(f, fi.Size()); err == nil {
+			offsets = offsets[:0]
+			for _, b := range idx.blocks {
+				offsets = append(offsets, b.offset)
+			}
+		}
+	}
+	for _, o := range offsets {
+		size, err := xzBlockDictSize(f, o)
+		if err != nil {
+			return err
+		}
+		if size > max {
+			return &LimitError{"dictionary", max, size}
+		}
 	}
-	return r, nil
+	return nil
 }
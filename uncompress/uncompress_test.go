@@ -82,6 +82,15 @@ func TestUncompress(t *testing.T) {
 			if got, want := len(b), tt.uncompressedByteLen; got != want {
 				t.Errorf("byte len got %d want %d", got, want)
 			}
+
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed, uncompressed := r.(Counter).BytesRead()
+			if compressed != fi.Size() || uncompressed != int64(len(b)) {
+				t.Errorf("bytes read got %d, %d want %d, %d", compressed, uncompressed, fi.Size(), len(b))
+			}
 		})
 	}
 }
@@ -0,0 +1,325 @@
+package uncompress
+
+// xz provides parsing of the structure of xz files, as set out in the
+// xz file format specification at https://tukaani.org/xz/xz-file-format.txt
+// The index at the end of each xz stream records the size of each
+// block, allowing blocks to be located without decompression.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	xzHeaderMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+)
+
+const (
+	xzStreamHeaderLen = 12
+	xzStreamFooterLen = 12
+	xzLZMA2FilterID   = 0x21
+)
+
+// errXZFormat reports an xz file which cannot be parsed.
+var errXZFormat = errors.New("invalid xz format")
+
+// xzBlock describes the position of an xz block in a file.
+type xzBlock struct {
+	offset             int64   // file offset of the block header
+	size               int64   // size of the block including padding and check
+	unpaddedSize       int64   // size of the block excluding padding
+	uncompressedOffset int64   // offset of the block in the uncompressed output
+	uncompressedSize   int64   // size of the uncompressed block
+	streamFlags        [2]byte // flags of the enclosing stream
+}
+
+// xzIndex lists the blocks of an xz file, in file order.
+type xzIndex struct {
+	blocks []xzBlock
+	size   int64 // total uncompressed size
+}
+
+// readXZIndex reads the indexes of each stream in the xz file of size
+// bytes held in r, working backwards from the end of the file.
+func readXZIndex(r io.ReaderAt, size int64) (*xzIndex, error) {
+	var streams [][]xzBlock
+	end := size
+	for end > 0 {
+		// skip stream padding
+		var word [4]byte
+		for end >= 4 {
+			if _, err := r.ReadAt(word[:], end-4); err != nil {
+				return nil, err
+			}
+			if word != [4]byte{} {
+				break
+			}
+			end -= 4
+		}
+		blocks, start, err := readXZStream(r, end)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, blocks)
+		end = start
+	}
+
+	idx := &xzIndex{}
+	for i := len(streams) - 1; i >= 0; i-- {
+		for _, b := range streams[i] {
+			b.uncompressedOffset = idx.size
+			idx.size += b.uncompressedSize
+			idx.blocks = append(idx.blocks, b)
+		}
+	}
+	return idx, nil
+}
+
+// readXZStream reads the index of the xz stream ending at end,
+// returning its blocks and the file offset of the start of the stream.
+func readXZStream(r io.ReaderAt, end int64) ([]xzBlock, int64, error) {
+	if end < xzStreamHeaderLen+xzStreamFooterLen {
+		return nil, 0, errXZFormat
+	}
+	footer := make([]byte, xzStreamFooterLen)
+	if _, err := r.ReadAt(footer, end-xzStreamFooterLen); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(footer[10:], xzFooterMagic) {
+		return nil, 0, fmt.Errorf("%w: footer magic not found", errXZFormat)
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) {
+		return nil, 0, fmt.Errorf("%w: footer checksum mismatch", errXZFormat)
+	}
+	var flags [2]byte
+	copy(flags[:], footer[8:10])
+	backwardSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+
+	indexStart := end - xzStreamFooterLen - backwardSize
+	if indexStart < xzStreamHeaderLen {
+		return nil, 0, fmt.Errorf("%w: index size out of range", errXZFormat)
+	}
+	index := make([]byte, backwardSize)
+	if _, err := r.ReadAt(index, indexStart); err != nil {
+		return nil, 0, err
+	}
+	records, err := parseXZIndex(index)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// locate the blocks, which precede the index
+	var blocksSize int64
+	for _, rec := range records {
+		blocksSize += roundUp4(rec[0])
+	}
+	start := indexStart - blocksSize - xzStreamHeaderLen
+	if start < 0 {
+		return nil, 0, fmt.Errorf("%w: block sizes out of range", errXZFormat)
+	}
+	header := make([]byte, xzStreamHeaderLen)
+	if _, err := r.ReadAt(header, start); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(header[:6], xzHeaderMagic) || !bytes.Equal(header[6:8], flags[:]) {
+		return nil, 0, fmt.Errorf("%w: stream header mismatch", errXZFormat)
+	}
+
+	blocks := make([]xzBlock, 0, len(records))
+	offset := start + xzStreamHeaderLen
+	for _, rec := range records {
+		b := xzBlock{
+			offset:           offset,
+			size:             roundUp4(rec[0]),
+			unpaddedSize:     rec[0],
+			uncompressedSize: rec[1],
+			streamFlags:      flags,
+		}
+		blocks = append(blocks, b)
+		offset += b.size
+	}
+	return blocks, start, nil
+}
+
+// parseXZIndex parses an xz index into pairs of unpadded and
+// uncompressed block sizes.
+func parseXZIndex(index []byte) ([][2]int64, error) {
+	if len(index) < 8 || index[0] != 0x00 {
+		return nil, fmt.Errorf("%w: index indicator not found", errXZFormat)
+	}
+	body := index[:len(index)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(index[len(index)-4:]) {
+		return nil, fmt.Errorf("%w: index checksum mismatch", errXZFormat)
+	}
+	br := bytes.NewReader(body[1:])
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errXZFormat, err)
+	}
+	if n > uint64(len(body)) {
+		return nil, fmt.Errorf("%w: record count out of range", errXZFormat)
+	}
+	records := make([][2]int64, 0, n)
+	for range n {
+		unpadded, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errXZFormat, err)
+		}
+		uncompressed, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errXZFormat, err)
+		}
+		if unpadded == 0 || unpadded > 1<<62 || uncompressed > 1<<62 {
+			return nil, fmt.Errorf("%w: record size out of range", errXZFormat)
+		}
+		records = append(records, [2]int64{int64(unpadded), int64(uncompressed)})
+	}
+	return records, nil
+}
+
+// xzBlockDictSize returns the LZMA2 dictionary size recorded in the
+// block header at offset in r.
+func xzBlockDictSize(r io.ReaderAt, offset int64) (int64, error) {
+	var sizeByte [1]byte
+	if _, err := r.ReadAt(sizeByte[:], offset); err != nil {
+		return 0, err
+	}
+	if sizeByte[0] == 0x00 {
+		return 0, fmt.Errorf("%w: block header not found", errXZFormat)
+	}
+	header := make([]byte, (int(sizeByte[0])+1)*4)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return 0, err
+	}
+	body := header[:len(header)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[len(header)-4:]) {
+		return 0, fmt.Errorf("%w: block header checksum mismatch", errXZFormat)
+	}
+
+	flags := body[1]
+	br := bytes.NewReader(body[2:])
+	if flags&0x40 != 0 { // compressed size present
+		if _, err := binary.ReadUvarint(br); err != nil {
+			return 0, fmt.Errorf("%w: %w", errXZFormat, err)
+		}
+	}
+	if flags&0x80 != 0 { // uncompressed size present
+		if _, err := binary.ReadUvarint(br); err != nil {
+			return 0, fmt.Errorf("%w: %w", errXZFormat, err)
+		}
+	}
+	var dictSize int64
+	filters := int(flags&0x03) + 1
+	for range filters {
+		id, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", errXZFormat, err)
+		}
+		propsLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", errXZFormat, err)
+		}
+		if propsLen > uint64(br.Len()) {
+			return 0, fmt.Errorf("%w: filter properties out of range", errXZFormat)
+		}
+		props := make([]byte, propsLen)
+		_, _ = io.ReadFull(br, props)
+		if id == xzLZMA2FilterID && propsLen == 1 {
+			dictSize = lzma2DictSize(props[0])
+		}
+	}
+	return dictSize, nil
+}
+
+// lzma2DictSize decodes an LZMA2 dictionary size property.
+func lzma2DictSize(b byte) int64 {
+	bits := int64(b & 0x3f)
+	if bits >= 40 {
+		return 0xffffffff
+	}
+	return (2 | (bits & 1)) << (bits/2 + 11)
+}
+
+// roundUp4 rounds n up to a multiple of four.
+func roundUp4(n int64) int64 {
+	return (n + 3) &^ 3
+}
+
+// xzSegment is an xz block, decoded by wrapping it in an xz stream of
+// its own.
+type xzSegment struct {
+	r     io.ReaderAt
+	block xzBlock
+}
+
+// decode decodes the block.
+func (s *xzSegment) decode(l *segmentLimits) ([]byte, io.Reader, error) {
+	block := make([]byte, s.block.size)
+	if _, err := s.r.ReadAt(block, s.block.offset); err != nil {
+		return nil, nil, err
+	}
+	r, err := xz.NewReader(io.MultiReader(
+		bytes.NewReader(xzStreamHeader(s.block)),
+		bytes.NewReader(block),
+		bytes.NewReader(xzStreamTrailer(s.block)),
+	))
+	if err != nil {
+		return nil, nil, err
+	}
+	return l.read(r, s.size())
+}
+
+// merge is not required for xz blocks, which are located by the index.
+func (s *xzSegment) merge(next segment) (segment, bool) {
+	return nil, false
+}
+
+// size is the compressed size of the segment.
+func (s *xzSegment) size() int64 {
+	return s.block.size
+}
+
+// xzSegments provides the blocks listed in idx, held in r.
+func xzSegments(r io.ReaderAt, idx *xzIndex) segmentFunc {
+	return func(yield func(segment) bool) error {
+		for _, b := range idx.blocks {
+			if !yield(&xzSegment{r: r, block: b}) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// xzStreamHeader returns the header of an xz stream holding block b.
+func xzStreamHeader(b xzBlock) []byte {
+	header := append([]byte(nil), xzHeaderMagic...)
+	header = append(header, b.streamFlags[:]...)
+	return binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(b.streamFlags[:]))
+}
+
+// xzStreamTrailer returns the index and footer of an xz stream holding
+// only block b.
+func xzStreamTrailer(b xzBlock) []byte {
+	index := []byte{0x00}
+	index = binary.AppendUvarint(index, 1)
+	index = binary.AppendUvarint(index, uint64(b.unpaddedSize))
+	index = binary.AppendUvarint(index, uint64(b.uncompressedSize))
+	for len(index)%4 != 0 {
+		index = append(index, 0x00)
+	}
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, b.streamFlags[:]...)
+	trailer := binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(footer))
+	trailer = append(trailer, footer...)
+	return append(trailer, xzFooterMagic...)
+}
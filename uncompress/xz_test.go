@@ -0,0 +1,47 @@
+package uncompress
+
+import (
+	"os"
+	"testing"
+)
+
+func TestXZIndex(t *testing.T) {
+	tests := []struct {
+		file   string
+		blocks int
+		dict   int64
+	}{
+		{"testdata/golang.mbox.xz", 1, 64 << 20},
+		{"testdata/golang.blocks.mbox.xz", 7, 8 << 20},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := readXZIndex(f, fi.Size())
+		if err != nil {
+			t.Fatalf("%s: %s", tt.file, err)
+		}
+		if got, want := len(idx.blocks), tt.blocks; got != want {
+			t.Errorf("%s blocks got %d want %d", tt.file, got, want)
+		}
+		if got, want := idx.size, int64(26097); got != want {
+			t.Errorf("%s size got %d want %d", tt.file, got, want)
+		}
+		for i, b := range idx.blocks {
+			size, err := xzBlockDictSize(f, b.offset)
+			if err != nil {
+				t.Fatalf("%s block %d: %s", tt.file, i, err)
+			}
+			if got, want := size, tt.dict; got != want {
+				t.Errorf("%s block %d dict size got %d want %d", tt.file, i, got, want)
+			}
+		}
+		_ = f.Close()
+	}
+}